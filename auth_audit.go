@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	client "github.com/ory/kratos-client-go"
+)
+
+// Authentication events recorded in audit_auth_log
+const (
+	authEventLogin            = "login"
+	authEventLogout           = "logout"
+	authEventSessionValidated = "session_validated"
+	authEventFailed           = "auth_failed"
+)
+
+const (
+	authAuditWorkers   = 2
+	authAuditQueueSize = 1024
+)
+
+// AuthAuditEntry is one row of the authentication audit log. UserID is nil
+// for failures where the caller could not be identified.
+type AuthAuditEntry struct {
+	ID           string    `json:"id"`
+	UserID       *string   `json:"user_id"`
+	EventType    string    `json:"event_type"`
+	IPAddress    string    `json:"ip_address"`
+	UserAgent    string    `json:"user_agent"`
+	SessionID    *string   `json:"session_id"`
+	Success      bool      `json:"success"`
+	ErrorMessage *string   `json:"error_message"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type AuthAuditFilter struct {
+	UserID   string
+	From     *time.Time
+	To       *time.Time
+	Page     int
+	PageSize int
+}
+
+// authAuditEntryFromRequest starts an entry with the caller's address and
+// user agent
+func (s *Server) authAuditEntryFromRequest(r *http.Request, eventType string) AuthAuditEntry {
+	return AuthAuditEntry{
+		EventType: eventType,
+		IPAddress: s.clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// authAuditEntryFromSession starts an entry for a Kratos session. Hooks are
+// called by Kratos, so the address and user agent come from the session's
+// most recent device rather than the hook request.
+func authAuditEntryFromSession(session *client.Session, eventType string) AuthAuditEntry {
+	entry := AuthAuditEntry{EventType: eventType, Success: true}
+	if session == nil {
+		return entry
+	}
+	entry.SessionID = &session.Id
+	if devices := session.Devices; len(devices) > 0 {
+		device := devices[len(devices)-1]
+		entry.IPAddress = device.GetIpAddress()
+		entry.UserAgent = device.GetUserAgent()
+	}
+	return entry
+}
+
+// recordAuthEvent appends an entry to the authentication audit log. Pass a
+// transaction to keep the entry only if the surrounding change commits.
+func recordAuthEvent(exec sqlExecer, entry AuthAuditEntry) error {
+	_, err := exec.Exec(`
+		INSERT INTO audit_auth_log (user_id, event_type, ip_address, user_agent, session_id, success, error_message)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		entry.UserID, entry.EventType, entry.IPAddress, entry.UserAgent,
+		entry.SessionID, entry.Success, entry.ErrorMessage,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record auth event %s: %w", entry.EventType, err)
+	}
+	return nil
+}
+
+// startAuthAuditWorkers launches the pool that writes queued auth events
+// until ctx is cancelled
+func (s *Server) startAuthAuditWorkers(ctx context.Context, n int) {
+	for i := 0; i < n; i++ {
+		s.goBackground(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case entry := <-s.authAuditQueue:
+					if err := recordAuthEvent(s.db, entry); err != nil {
+						logError("%v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// auditAuthEvent queues entry for the audit workers so session validation
+// does not wait on the insert. When the queue is full the entry is dropped
+// rather than piling up goroutines; failures are only logged.
+func (s *Server) auditAuthEvent(entry AuthAuditEntry) {
+	select {
+	case s.authAuditQueue <- entry:
+	default:
+		logWarning("Auth audit queue full, dropping %s event", entry.EventType)
+	}
+}
+
+// hasCredentials reports whether the request carries one of the credentials
+// validateCredentials accepts. Anonymous requests, and those using other
+// schemes such as SCIM's Basic auth, are not audited as failures.
+func hasCredentials(r *http.Request) bool {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") || r.Header.Get("X-API-Key") != "" {
+		return true
+	}
+	_, err := r.Cookie("ory_kratos_session")
+	return err == nil
+}
+
+func (s *Server) getAuthAuditEntries(filter AuthAuditFilter) ([]AuthAuditEntry, int, error) {
+	conditions := []string{"TRUE"}
+	args := []interface{}{}
+
+	if filter.UserID != "" {
+		args = append(args, filter.UserID)
+		conditions = append(conditions, fmt.Sprintf("user_id = $%d", len(args)))
+	}
+	if filter.From != nil {
+		args = append(args, *filter.From)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if filter.To != nil {
+		args = append(args, *filter.To)
+		conditions = append(conditions, fmt.Sprintf("created_at <= $%d", len(args)))
+	}
+
+	where := strings.Join(conditions, " AND ")
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM audit_auth_log WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	args = append(args, filter.PageSize, (filter.Page-1)*filter.PageSize)
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT id, user_id, event_type, ip_address, user_agent, session_id, success, error_message, created_at
+		FROM audit_auth_log
+		WHERE %s
+		ORDER BY created_at DESC, id
+		LIMIT $%d OFFSET $%d`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	return scanAuthAuditEntries(rows), total, nil
+}
+
+// getUserAuthAuditEntries returns every authentication event of userID,
+// newest first
+func (s *Server) getUserAuthAuditEntries(userID string) ([]AuthAuditEntry, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, event_type, ip_address, user_agent, session_id, success, error_message, created_at
+		FROM audit_auth_log
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanAuthAuditEntries(rows), rows.Err()
+}
+
+// scanAuthAuditEntries reads audit_auth_log rows, skipping any that fail
+// to scan
+func scanAuthAuditEntries(rows *sql.Rows) []AuthAuditEntry {
+	entries := []AuthAuditEntry{}
+	for rows.Next() {
+		var entry AuthAuditEntry
+		var userID, sessionID, errorMessage sql.NullString
+
+		err := rows.Scan(&entry.ID, &userID, &entry.EventType, &entry.IPAddress, &entry.UserAgent,
+			&sessionID, &entry.Success, &errorMessage, &entry.CreatedAt)
+		if err != nil {
+			logWarning("Error scanning auth audit row: %v", err)
+			continue
+		}
+
+		if userID.Valid {
+			entry.UserID = &userID.String
+		}
+		if sessionID.Valid {
+			entry.SessionID = &sessionID.String
+		}
+		if errorMessage.Valid {
+			entry.ErrorMessage = &errorMessage.String
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// adminListAuthAudit lists authentication events, newest first, filtered
+// by ?user_id=&from=&to= (system admin)
+func (s *Server) adminListAuthAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := AuthAuditFilter{UserID: query.Get("user_id")}
+
+	if filter.UserID != "" && validateUUID(filter.UserID) != nil {
+		WriteError(w, http.StatusBadRequest, ErrCodeBadRequest, "Invalid user_id")
+		return
+	}
+
+	for param, target := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		raw := query.Get(param)
+		if raw == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, ErrCodeBadRequest, fmt.Sprintf("Invalid %s, expected RFC 3339 timestamp", param))
+			return
+		}
+		*target = &parsed
+	}
+
+	var err error
+	filter.Page, filter.PageSize, err = parsePagination(r, 50, 500)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+		return
+	}
+
+	entries, total, err := s.getAuthAuditEntries(filter)
+	if err != nil {
+		logError("Failed to fetch auth audit log: %v", err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch auth audit log")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries":   entries,
+		"total":     total,
+		"page":      filter.Page,
+		"page_size": filter.PageSize,
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHasCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   bool
+	}{
+		{"anonymous", "", "", false},
+		{"bearer", "Authorization", "Bearer ory_st_token", true},
+		{"basic", "Authorization", "Basic c2NpbTp0b2tlbg==", false},
+		{"api key", "X-API-Key", "userms_key", true},
+		{"cookie", "Cookie", "ory_kratos_session=token", true},
+		{"other cookie", "Cookie", "theme=dark", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/users/me", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			if got := hasCredentials(r); got != tt.want {
+				t.Errorf("hasCredentials = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionMiddlewareSkipsOwnAuthRoutes(t *testing.T) {
+	kratos := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Kratos asked about %s", r.URL.Path)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	db, _ := newFakeDB(t)
+	s := newTestServer(t, db, kratos)
+
+	for _, path := range []string{"/scim/v2/Users", "/hooks/after-login", "/metrics", "/health"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer not-a-session")
+		s.sessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := r.Context().Value(sessionKey).(sessionResult); ok {
+				t.Errorf("%s: session validated", path)
+			}
+		})).ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	if n := len(s.authAuditQueue); n != 0 {
+		t.Errorf("%d auth events queued, want none", n)
+	}
+}
+
+func TestAuditAuthEventDropsWhenFull(t *testing.T) {
+	s := &Server{authAuditQueue: make(chan AuthAuditEntry, 2)}
+
+	for i := 0; i < 5; i++ {
+		s.auditAuthEvent(AuthAuditEntry{EventType: authEventFailed})
+	}
+	if n := len(s.authAuditQueue); n != 2 {
+		t.Errorf("%d entries queued, want the queue size 2", n)
+	}
+}
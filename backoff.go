@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff produces exponentially growing delays with random jitter
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	Jitter  time.Duration
+
+	attempt int
+}
+
+// Next returns the delay before the next attempt: Initial doubled for each
+// previous attempt, capped at Max, plus or minus up to Jitter.
+func (b *Backoff) Next() time.Duration {
+	delay := b.Initial
+	for i := 0; i < b.attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	b.attempt++
+
+	if b.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(2*b.Jitter)+1)) - b.Jitter
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// Reset starts the sequence over from Initial
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
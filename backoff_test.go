@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoffNext(t *testing.T) {
+	b := &Backoff{Initial: time.Second, Max: 5 * time.Second}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := b.Next(); got != w {
+			t.Errorf("attempt %d: delay = %v, want %v", i+1, got, w)
+		}
+	}
+
+	b.Reset()
+	if got := b.Next(); got != time.Second {
+		t.Errorf("after Reset: delay = %v, want %v", got, time.Second)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := &Backoff{Initial: 100 * time.Millisecond, Max: 100 * time.Millisecond, Jitter: 20 * time.Millisecond}
+
+	for i := 0; i < 100; i++ {
+		if got := b.Next(); got < 80*time.Millisecond || got > 120*time.Millisecond {
+			t.Fatalf("delay = %v, want 100ms ± 20ms", got)
+		}
+	}
+}
+
+// flakyConnector refuses connections until attempt succeedOn
+type flakyConnector struct {
+	fake      *fakeDB
+	succeedOn int
+	attempts  int
+}
+
+func (c *flakyConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	c.attempts++
+	if c.attempts < c.succeedOn {
+		return nil, errors.New("connection refused")
+	}
+	return c.fake.Connect(ctx)
+}
+
+func (c *flakyConnector) Driver() driver.Driver { return fakeDriver{} }
+
+func TestWaitForDB(t *testing.T) {
+	connector := &flakyConnector{fake: &fakeDB{t: t}, succeedOn: 4}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	backoff := &Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond}
+	if err := waitForDB(db, time.Second, backoff); err != nil {
+		t.Fatalf("waitForDB: %v", err)
+	}
+	if connector.attempts != 4 {
+		t.Errorf("connected after %d attempts, want 4", connector.attempts)
+	}
+}
+
+func TestWaitForDBTimeout(t *testing.T) {
+	connector := &flakyConnector{fake: &fakeDB{t: t}, succeedOn: 1000}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	backoff := &Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond}
+	err := waitForDB(db, 50*time.Millisecond, backoff)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("err = %v, want timeout wrapping the last ping error", err)
+	}
+}
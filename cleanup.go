@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// cleanupJob deletes rows that are no longer useful from one table
+type cleanupJob struct {
+	table string
+	query string
+}
+
+// cleanupJobs run on every cleanup pass. Accepted invitations are kept as a
+// record of who joined how, and expired ones for a week so a resend can
+// still extend them; revoked API keys are kept until they would have
+// expired anyway; expired personal access tokens linger for a week so users
+// can see why a token stopped working.
+var cleanupJobs = []cleanupJob{
+	{
+		table: "invitations",
+		query: "DELETE FROM invitations WHERE expires_at < NOW() - INTERVAL '7 days' AND used_at IS NULL",
+	},
+	{
+		table: "api_keys",
+		query: "DELETE FROM api_keys WHERE expires_at < NOW() AND revoked_at IS NOT NULL",
+	},
+	{
+		table: "personal_access_tokens",
+		query: "DELETE FROM personal_access_tokens WHERE expires_at < NOW() - INTERVAL '7 days'",
+	},
+	{
+		table: "webhook_events",
+		query: "DELETE FROM webhook_events WHERE processed_at < NOW() - INTERVAL '7 days'",
+	},
+}
+
+// runCleanup deletes expired rows every interval until ctx is cancelled
+func (s *Server) runCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.cleanupExpiredRows()
+		}
+	}
+}
+
+// cleanupExpiredRows runs each cleanup job once. A failing job is logged and
+// does not stop the others.
+func (s *Server) cleanupExpiredRows() {
+	start := time.Now()
+	total := int64(0)
+
+	for _, job := range cleanupJobs {
+		result, err := s.db.Exec(job.query)
+		if err != nil {
+			logError("Cleanup of %s failed: %v", job.table, err)
+			continue
+		}
+		deleted, _ := result.RowsAffected()
+		if deleted > 0 {
+			cleanupRowsDeleted.WithLabelValues(job.table).Add(float64(deleted))
+			logDB("Cleanup deleted %d rows from %s", deleted, job.table)
+		}
+		total += deleted
+	}
+
+	logInfo("Cleanup finished in %v, deleted %d rows", time.Since(start).Round(time.Millisecond), total)
+}
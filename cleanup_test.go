@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCleanupExpiredRows(t *testing.T) {
+	db, fake := newFakeDB(t, fakeQuery{match: "DELETE FROM"})
+	s := newTestServer(t, db, http.NotFoundHandler())
+
+	s.cleanupExpiredRows()
+
+	for _, job := range cleanupJobs {
+		if !fake.executed(job.query) {
+			t.Errorf("cleanup of %s did not run", job.table)
+		}
+	}
+	if !fake.executed("DELETE FROM invitations WHERE expires_at < NOW() - INTERVAL '7 days'") {
+		t.Error("expired invitations are deleted without a grace period")
+	}
+	if !fake.executed("DELETE FROM webhook_events WHERE processed_at < NOW() - INTERVAL '7 days'") {
+		t.Error("processed webhook events are not pruned")
+	}
+}
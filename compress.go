@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// Responses smaller than this are sent uncompressed; gzip's framing would
+// eat most of the saving
+const gzipMinSize = 1024
+
+// gzipMiddleware compresses JSON responses for clients that accept gzip.
+// The first gzipMinSize bytes are buffered to decide whether compressing is
+// worth it.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(acceptEncoding string) bool {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the status and the start of the body until
+// it knows whether to compress
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	buf         bytes.Buffer
+	decided     bool
+	gz          *gzip.Writer
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.statusCode = code
+	gw.wroteHeader = true
+}
+
+func (gw *gzipResponseWriter) Write(p []byte) (int, error) {
+	gw.wroteHeader = true
+	if gw.decided {
+		if gw.gz != nil {
+			return gw.gz.Write(p)
+		}
+		return gw.ResponseWriter.Write(p)
+	}
+
+	gw.buf.Write(p)
+	if gw.buf.Len() >= gzipMinSize {
+		if err := gw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide sends the status line and buffered body, compressing if the
+// response is JSON, large enough and not already encoded
+func (gw *gzipResponseWriter) decide(largeEnough bool) error {
+	gw.decided = true
+
+	header := gw.Header()
+	if isJSONContentType(header.Get("Content-Type")) {
+		header.Add("Vary", "Accept-Encoding")
+		if largeEnough && header.Get("Content-Encoding") == "" {
+			header.Set("Content-Encoding", "gzip")
+			header.Del("Content-Length")
+			gw.gz = gzip.NewWriter(gw.ResponseWriter)
+		}
+	}
+
+	if gw.wroteHeader {
+		gw.ResponseWriter.WriteHeader(gw.statusCode)
+	}
+	if gw.buf.Len() == 0 {
+		return nil
+	}
+
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(gw.buf.Bytes())
+	} else {
+		_, err = gw.ResponseWriter.Write(gw.buf.Bytes())
+	}
+	gw.buf.Reset()
+	return err
+}
+
+// Flush sends whatever is buffered. Streaming responses are flushed before
+// they reach gzipMinSize, so they go out uncompressed.
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.decided {
+		gw.decide(false)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if flusher, ok := gw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close sends a response that never reached gzipMinSize and terminates the
+// gzip stream
+func (gw *gzipResponseWriter) Close() {
+	if !gw.decided {
+		gw.decide(false)
+	}
+	if gw.gz != nil {
+		if err := gw.gz.Close(); err != nil {
+			logWarning("Failed to finish gzip response: %v", err)
+		}
+	}
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigWatch(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("RATE_LIMIT_RPM", "60")
+
+	cfg := loadConfig()
+	changes := make(chan *Config, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cfg.Watch(ctx, 10*time.Millisecond, func(next *Config) { changes <- next })
+
+	// Unchanged settings must not trigger a reload
+	select {
+	case next := <-changes:
+		t.Fatalf("reloaded without a change: %+v", next)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	t.Setenv("RATE_LIMIT_RPM", "120")
+	select {
+	case next := <-changes:
+		if next.RateLimitRPM != 120 {
+			t.Errorf("RateLimitRPM = %d, want 120", next.RateLimitRPM)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("onChange not called after RATE_LIMIT_RPM changed")
+	}
+}
+
+// setRequiredEnv sets the variables Validate requires outside DEV_MODE
+func setRequiredEnv(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("DEV_MODE", "")
+	t.Setenv("KRATOS_PUBLIC_URL", "http://kratos:4433")
+	t.Setenv("KRATOS_ADMIN_URL", "http://kratos:4434")
+	t.Setenv("DATABASE_URL", "postgres://userms@db:5432/userms")
+}
+
+func TestConfigValidateRequired(t *testing.T) {
+	setRequiredEnv(t)
+	if err := loadConfig().Validate(); err != nil {
+		t.Fatalf("Validate with everything set: %v", err)
+	}
+
+	t.Setenv("KRATOS_ADMIN_URL", "")
+	t.Setenv("DATABASE_URL", "")
+	err := loadConfig().Validate()
+	if err == nil {
+		t.Fatal("Validate accepted unset KRATOS_ADMIN_URL and DATABASE_URL")
+	}
+	for _, key := range []string{"KRATOS_ADMIN_URL", "DATABASE_URL"} {
+		if !strings.Contains(err.Error(), key+" is required") {
+			t.Errorf("error %q does not report %s", err, key)
+		}
+	}
+	if strings.Contains(err.Error(), "KRATOS_PUBLIC_URL") {
+		t.Errorf("error %q reports KRATOS_PUBLIC_URL, which is set", err)
+	}
+
+	t.Setenv("DEV_MODE", "true")
+	cfg := loadConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate in DEV_MODE: %v", err)
+	}
+	if cfg.DatabaseURL == "" || cfg.KratosAdminURL == "" {
+		t.Error("DEV_MODE did not fill in the localhost defaults")
+	}
+}
+
+func TestConfigValidateParseErrors(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("RATE_LIMIT_RPM", "sixty")
+	t.Setenv("DB_MAX_OPEN_CONNS", "0")
+	t.Setenv("RATE_LIMIT_IP_RPS", "-1")
+
+	err := loadConfig().Validate()
+	if err == nil {
+		t.Fatal("Validate accepted unparseable numbers")
+	}
+	for _, key := range []string{"RATE_LIMIT_RPM", "DB_MAX_OPEN_CONNS", "RATE_LIMIT_IP_RPS"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q does not report %s", err, key)
+		}
+	}
+}
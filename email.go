@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// EmailService sends notification emails through the SMTP relay configured
+// with SMTP_HOST, SMTP_PORT, SMTP_USER, SMTP_PASSWORD and EMAIL_FROM
+type EmailService struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// newEmailService returns nil when SMTP_HOST is not set. Without a relay,
+// emails are only logged.
+func newEmailService(cfg *Config) *EmailService {
+	if cfg.SMTPHost == "" {
+		return nil
+	}
+
+	svc := &EmailService{
+		addr: net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort),
+		from: cfg.EmailFrom,
+	}
+	if cfg.SMTPUser != "" {
+		svc.auth = smtp.PlainAuth("", cfg.SMTPUser, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	return svc
+}
+
+func (e *EmailService) SendMemberInvitation(to, orgName, invitationLink string) error {
+	return e.send(to, fmt.Sprintf("You're invited to join %s", orgName), fmt.Sprintf(
+		"You have been invited to join %s.\r\n\r\n"+
+			"Accept the invitation here:\r\n%s\r\n\r\n"+
+			"If you weren't expecting this, you can ignore this email.\r\n",
+		orgName, invitationLink))
+}
+
+func (e *EmailService) SendWelcomeEmail(to, firstName string) error {
+	greeting := "Welcome!"
+	if firstName != "" {
+		greeting = fmt.Sprintf("Welcome, %s!", firstName)
+	}
+	return e.send(to, "Welcome", greeting+"\r\n\r\n"+
+		"Your account has been created. You can now sign in and join organizations.\r\n")
+}
+
+func (e *EmailService) SendRoleChangedEmail(to, orgName, newRole string) error {
+	return e.send(to, fmt.Sprintf("Your role in %s has changed", orgName), fmt.Sprintf(
+		"Your role in %s is now %s.\r\n\r\n"+
+			"If you think this is a mistake, contact an administrator of the organization.\r\n",
+		orgName, newRole))
+}
+
+func (e *EmailService) send(to, subject, body string) error {
+	// Addresses and subjects end up in headers, so a stray newline would
+	// let user-supplied values (e.g. organization names) add headers
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(e.from, "\r\n") {
+		return fmt.Errorf("invalid email address")
+	}
+	subject = strings.NewReplacer("\r", " ", "\n", " ").Replace(subject)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(body)
+
+	return smtp.SendMail(e.addr, e.auth, e.from, []string{to}, msg.Bytes())
+}
+
+// sendEmail sends an email in the background unless userID has turned off
+// event on the email channel. Pass an empty userID when there is no
+// preference to check, e.g. for invitees without an account. Failures are
+// logged; they never affect the request that triggered the email.
+func (s *Server) sendEmail(userID, event, to string, send func(*EmailService) error) {
+	go func() {
+		if userID != "" && !s.notificationEnabled(userID, event, notificationChannelEmail) {
+			logInfo("Not emailing %s about %s, disabled in their preferences", to, event)
+			return
+		}
+
+		svc := newEmailService(s.config())
+		if svc == nil {
+			logInfo("SMTP not configured, skipping %s email to %s", event, to)
+			return
+		}
+		if err := send(svc); err != nil {
+			logError("Failed to send %s email to %s: %v", event, to, err)
+			return
+		}
+		logInfo("Sent %s email to %s", event, to)
+	}()
+}
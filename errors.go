@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes returned in the "code" field of every error response
+const (
+	ErrCodeBadRequest       = "BAD_REQUEST"
+	ErrCodeUnauthorized     = "UNAUTHORIZED"
+	ErrCodeForbidden        = "FORBIDDEN"
+	ErrCodeNotFound         = "NOT_FOUND"
+	ErrCodeNotAcceptable    = "NOT_ACCEPTABLE"
+	ErrCodeConflict         = "CONFLICT"
+	ErrCodeGone             = "GONE"
+	ErrCodeValidationFailed = "VALIDATION_FAILED"
+	ErrCodeRateLimited      = "RATE_LIMITED"
+	ErrCodeInternal         = "INTERNAL_ERROR"
+	ErrCodeUpstream         = "UPSTREAM_ERROR"
+	ErrCodeUnavailable      = "SERVICE_UNAVAILABLE"
+
+	ErrCodeEmailNotVerified = "EMAIL_NOT_VERIFIED"
+	ErrCodeAdminRequired    = "ADMIN_REQUIRED"
+)
+
+// APIError is the JSON body of every error response, e.g.
+// {"code": "NOT_FOUND", "message": "Organization not found"}
+type APIError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// WriteError responds with statusCode and an APIError body. Only the first
+// details map is used.
+func WriteError(w http.ResponseWriter, statusCode int, code, message string, details ...map[string]interface{}) {
+	apiErr := APIError{Code: code, Message: message}
+	if len(details) > 0 {
+		apiErr.Details = details[0]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(apiErr)
+}
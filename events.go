@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Events buffered per subscriber. A client that falls further behind
+	// misses events rather than holding up the publisher.
+	eventBufferSize = 16
+	// Comment lines are sent this often so proxies don't close idle streams
+	eventKeepAliveInterval = 30 * time.Second
+)
+
+// Event is a change to an organization pushed to its event stream. Types
+// match the webhook event names.
+type Event struct {
+	Type      string                 `json:"type"`
+	OrgID     string                 `json:"organization_id"`
+	Data      map[string]interface{} `json:"data"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+// EventBus fans organization events out to the streams subscribed to them.
+// It only reaches clients connected to this instance.
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers map[string][]chan Event
+	closed      bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[string][]chan Event)}
+}
+
+// Subscribe returns a channel receiving orgID's events. It is closed by
+// Unsubscribe or when the bus shuts down.
+func (b *EventBus) Subscribe(orgID string) chan Event {
+	ch := make(chan Event, eventBufferSize)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subscribers[orgID] = append(b.subscribers[orgID], ch)
+	return ch
+}
+
+func (b *EventBus) Unsubscribe(orgID string, ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs := b.subscribers[orgID]
+	for i, sub := range subs {
+		if sub == ch {
+			b.subscribers[orgID] = append(subs[:i], subs[i+1:]...)
+			close(ch)
+			break
+		}
+	}
+	if len(b.subscribers[orgID]) == 0 {
+		delete(b.subscribers, orgID)
+	}
+}
+
+// Publish sends an event to every subscriber of orgID without blocking
+func (b *EventBus) Publish(orgID, eventType string, data map[string]interface{}) {
+	event := Event{Type: eventType, OrgID: orgID, Data: data, Timestamp: time.Now().UTC()}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, ch := range b.subscribers[orgID] {
+		select {
+		case ch <- event:
+		default:
+			logWarning("Dropping %s event for a slow subscriber of organization %s", eventType, orgID)
+		}
+	}
+}
+
+// Close ends every open stream so server shutdown isn't held up by them
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for orgID, subs := range b.subscribers {
+		for _, ch := range subs {
+			close(ch)
+		}
+		delete(b.subscribers, orgID)
+	}
+	b.closed = true
+}
+
+// streamOrgEvents streams the organization's membership changes as
+// server-sent events until the client disconnects (members only)
+func (s *Server) streamOrgEvents(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSessionFromRequest(r)
+	if err != nil {
+		logAuth("Unauthorized event stream: %v", err)
+		WriteError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	orgID := mux.Vars(r)["id"]
+
+	if !s.isOrgMember(session.Identity.Id, orgID) {
+		logAuth("User %s not member of organization %s", session.Identity.Id, orgID)
+		WriteError(w, http.StatusForbidden, ErrCodeForbidden, "Forbidden")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logError("Response writer does not support streaming")
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Streaming not supported")
+		return
+	}
+
+	events := s.events.Subscribe(orgID)
+	defer s.events.Unsubscribe(orgID, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	logInfo("User %s subscribed to events of organization %s", session.Identity.Id, orgID)
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			logInfo("User %s disconnected from events of organization %s", session.Identity.Id, orgID)
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				logError("Failed to encode %s event: %v", event.Type, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, payload); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
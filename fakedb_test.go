@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeQuery answers every statement whose text contains match. Queries
+// return rows with columns; Execs report len(rows) rows affected. If respond
+// is set it computes the rows from the statement and its arguments instead.
+type fakeQuery struct {
+	match   string
+	columns []string
+	rows    [][]driver.Value
+	respond func(query string, args []driver.Value) [][]driver.Value
+	err     error
+}
+
+// fakeDB is a database/sql driver serving canned answers, so handlers can be
+// tested without Postgres. The first matching fakeQuery wins; statements
+// matching none fail the test. Runs of whitespace in statements are
+// collapsed to one space before matching.
+type fakeDB struct {
+	t       *testing.T
+	mu      sync.Mutex
+	queries []fakeQuery
+	seen    []string
+}
+
+func newFakeDB(t *testing.T, queries ...fakeQuery) (*sql.DB, *fakeDB) {
+	t.Helper()
+	fake := &fakeDB{t: t, queries: queries}
+	db := sql.OpenDB(fake)
+	t.Cleanup(func() { db.Close() })
+	return db, fake
+}
+
+// executed reports whether a statement containing match was run
+func (f *fakeDB) executed(match string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, query := range f.seen {
+		if strings.Contains(query, match) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeDB) answer(query string, args []driver.Value) (fakeQuery, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query = strings.Join(strings.Fields(query), " ")
+	f.seen = append(f.seen, query)
+	for _, candidate := range f.queries {
+		if strings.Contains(query, candidate.match) {
+			if candidate.respond != nil {
+				candidate.rows = candidate.respond(query, args)
+			}
+			return candidate, candidate.err
+		}
+	}
+	f.t.Errorf("unexpected query: %s", query)
+	return fakeQuery{}, fmt.Errorf("unexpected query")
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return fakeDriver{} }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, fmt.Errorf("fakeDB is opened with sql.OpenDB")
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	answer, err := s.db.answer(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(len(answer.rows)), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	answer, err := s.db.answer(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: answer.columns, rows: answer.rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
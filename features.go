@@ -0,0 +1,308 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Organization feature flags
+const (
+	featureEnableCustomRoles = "enable_custom_roles"
+	featureEnableAPIKeys     = "enable_api_keys"
+	featureEnableSCIM        = "enable_scim"
+	featureMaxTenantCount    = "max_tenant_count"
+)
+
+var orgFeatureNames = []string{
+	featureEnableCustomRoles,
+	featureEnableAPIKeys,
+	featureEnableSCIM,
+	featureMaxTenantCount,
+}
+
+// orgFeatureDefaults applies to organizations without a stored flag. Flags
+// guarding behaviour that predates them default to enabled so existing
+// organizations keep working.
+var orgFeatureDefaults = map[string]bool{
+	featureEnableCustomRoles: true,
+	featureEnableAPIKeys:     true,
+	featureEnableSCIM:        true,
+	featureMaxTenantCount:    false,
+}
+
+// OrgFeature is one feature flag of an organization. Metadata carries
+// flag-specific values, e.g. {"limit": 10} for max_tenant_count.
+type OrgFeature struct {
+	FeatureName string                 `json:"feature_name" validate:"required,oneof=enable_custom_roles enable_api_keys enable_scim max_tenant_count"`
+	Enabled     bool                   `json:"enabled"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	UpdatedAt   *time.Time             `json:"updated_at,omitempty"`
+}
+
+// hasFeature reports whether the organization has featureName enabled,
+// falling back to orgFeatureDefaults when no flag is stored
+func (s *Server) hasFeature(orgID, featureName string) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRow(`
+		SELECT enabled FROM organization_features
+		WHERE org_id = $1 AND feature_name = $2`,
+		orgID, featureName,
+	).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return orgFeatureDefaults[featureName], nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return enabled, nil
+}
+
+// tenantLimit returns the limit in max_tenant_count metadata, which must
+// be a non-negative whole number
+func tenantLimit(metadata map[string]interface{}) (int, bool) {
+	limit, ok := metadata["limit"].(float64)
+	if !ok || limit < 0 || limit != float64(int(limit)) {
+		return 0, false
+	}
+	return int(limit), true
+}
+
+// getMaxTenantCount returns the tenant limit set by orgID's
+// max_tenant_count flag, or nil if the flag is off
+func getMaxTenantCount(q sqlQueryer, orgID string) (*int, error) {
+	var metadataJSON []byte
+	err := q.QueryRow(`
+		SELECT metadata FROM organization_features
+		WHERE org_id = $1 AND feature_name = $2 AND enabled`,
+		orgID, featureMaxTenantCount,
+	).Scan(&metadataJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata map[string]interface{}
+	if err := json.Unmarshal(metadataJSON, &metadata); err != nil {
+		return nil, err
+	}
+	limit, ok := tenantLimit(metadata)
+	if !ok {
+		return nil, fmt.Errorf("invalid max_tenant_count metadata %s", metadataJSON)
+	}
+	return &limit, nil
+}
+
+// requireAPIKeyFeature rejects API key requests to organizations that have
+// enable_api_keys turned off. Other requests pass through unchanged.
+func (s *Server) requireAPIKeyFeature(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := sessionFromContext(r.Context())
+		orgID := mux.Vars(r)["id"]
+		if !ok || !isAPIKeySession(session) || validateUUID(orgID) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		enabled, err := s.hasFeature(orgID, featureEnableAPIKeys)
+		if err != nil {
+			logError("Failed to check API key feature of organization %s: %v", orgID, err)
+			WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to check organization features")
+			return
+		}
+		if !enabled {
+			logAuth("Rejected API key %s for organization %s: API keys are disabled for it", session.Id, orgID)
+			WriteError(w, http.StatusForbidden, ErrCodeForbidden, "Forbidden - API keys are not enabled for this organization")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getOrgFeatures returns every known flag of the organization, with stored
+// values applied over the defaults
+func (s *Server) getOrgFeatures(orgID string) ([]OrgFeature, error) {
+	rows, err := s.db.Query(`
+		SELECT feature_name, enabled, metadata, updated_at
+		FROM organization_features
+		WHERE org_id = $1`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]OrgFeature)
+	for rows.Next() {
+		var feature OrgFeature
+		var metadataJSON []byte
+		var updatedAt time.Time
+		if err := rows.Scan(&feature.FeatureName, &feature.Enabled, &metadataJSON, &updatedAt); err != nil {
+			return nil, err
+		}
+		if len(metadataJSON) > 0 {
+			json.Unmarshal(metadataJSON, &feature.Metadata)
+		}
+		feature.UpdatedAt = &updatedAt
+		stored[feature.FeatureName] = feature
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	features := make([]OrgFeature, 0, len(orgFeatureNames))
+	for _, name := range orgFeatureNames {
+		feature, ok := stored[name]
+		if !ok {
+			feature = OrgFeature{FeatureName: name, Enabled: orgFeatureDefaults[name]}
+		}
+		features = append(features, feature)
+	}
+	return features, nil
+}
+
+// getOrgFeaturesHandler lists an organization's feature flags. Owners and
+// system admins can read them.
+func (s *Server) getOrgFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSessionFromRequest(r)
+	if err != nil {
+		logAuth("Unauthorized get features: %v", err)
+		WriteError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	orgID := mux.Vars(r)["id"]
+
+	if !s.isOrgOwner(session.Identity.Id, orgID) && !s.isSystemAdminSession(session) {
+		logAuth("User %s not authorized to read features of organization %s", session.Identity.Id, orgID)
+		WriteError(w, http.StatusForbidden, ErrCodeForbidden, "Forbidden - Organization owner access required")
+		return
+	}
+
+	features, err := s.getOrgFeatures(orgID)
+	if err != nil {
+		logError("Failed to fetch features for organization %s: %v", orgID, err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch organization features")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"features": features})
+}
+
+// updateOrgFeatures stores the given flags. Flags left out of the request
+// keep their current value. Only system admins can change flags.
+func (s *Server) updateOrgFeatures(w http.ResponseWriter, r *http.Request) {
+	logInfo("Processing update organization features request")
+
+	session, err := s.getSessionFromRequest(r)
+	if err != nil {
+		logAuth("Unauthorized update features: %v", err)
+		WriteError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	if !s.isSystemAdminSession(session) {
+		logAuth("User %s not authorized to update features - system admin required", session.Identity.Id)
+		s.writeSystemAdminForbidden(w, session, ErrCodeForbidden)
+		return
+	}
+
+	orgID := mux.Vars(r)["id"]
+
+	var req []OrgFeature
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logWarning("Invalid request body for organization features: %v", err)
+		WriteError(w, http.StatusBadRequest, ErrCodeBadRequest, "Invalid request body")
+		return
+	}
+	if len(req) == 0 {
+		WriteError(w, http.StatusBadRequest, ErrCodeBadRequest, "No features to update")
+		return
+	}
+	for i := range req {
+		if errs := validateStruct(&req[i]); len(errs) > 0 {
+			WriteError(w, http.StatusBadRequest, ErrCodeValidationFailed, fmt.Sprintf("[%d].%s", i, errs[0].Error()))
+			return
+		}
+		if req[i].FeatureName == featureMaxTenantCount && req[i].Enabled {
+			if _, ok := tenantLimit(req[i].Metadata); !ok {
+				WriteError(w, http.StatusBadRequest, ErrCodeValidationFailed,
+					fmt.Sprintf("[%d].metadata.limit: must be a non-negative whole number", i))
+				return
+			}
+		}
+	}
+
+	org, err := s.getOrganizationFromDB(orgID)
+	if err != nil {
+		logError("Failed to fetch organization %s: %v", orgID, err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update organization features")
+		return
+	}
+	if org == nil {
+		WriteError(w, http.StatusNotFound, ErrCodeNotFound, "Organization not found")
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		logError("Failed to start transaction: %v", err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update organization features")
+		return
+	}
+	defer tx.Rollback()
+
+	changed := make(map[string]interface{}, len(req))
+	for _, feature := range req {
+		if feature.Metadata == nil {
+			feature.Metadata = map[string]interface{}{}
+		}
+		metadataJSON, _ := json.Marshal(feature.Metadata)
+		_, err = tx.Exec(`
+			INSERT INTO organization_features (org_id, feature_name, enabled, metadata)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (org_id, feature_name)
+			DO UPDATE SET enabled = $3, metadata = $4, updated_at = CURRENT_TIMESTAMP`,
+			orgID, feature.FeatureName, feature.Enabled, metadataJSON,
+		)
+		if err != nil {
+			logError("Failed to store feature %s for organization %s: %v", feature.FeatureName, orgID, err)
+			WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update organization features")
+			return
+		}
+		changed[feature.FeatureName] = feature.Enabled
+	}
+
+	if err = recordOrgAudit(tx, orgID, session.Identity.Id, auditFeaturesUpdated, "", changed); err != nil {
+		logError("Failed to audit feature change: %v", err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update organization features")
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		logError("Failed to commit feature change: %v", err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update organization features")
+		return
+	}
+
+	features, err := s.getOrgFeatures(orgID)
+	if err != nil {
+		logError("Failed to fetch features for organization %s: %v", orgID, err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch organization features")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"features": features})
+
+	logSuccess("Features updated for organization %s by %s", orgID, session.Identity.Id)
+}
@@ -17,61 +17,69 @@ const api = axios.create({
 export class ApiService {
   // User endpoints
   static async getCurrentUser(): Promise<User> {
-    const response = await api.get('/api/whoami');
+    const response = await api.get('/api/v1/whoami');
     return response.data;
   }
 
   static async getUsers(): Promise<User[]> {
-    const response = await api.get('/api/users');
-    return response.data;
+    const response = await api.get('/api/v1/users', { params: { limit: 500 } });
+    return response.data.users;
   }
 
   static async getUser(id: string): Promise<User> {
-    const response = await api.get(`/api/users/${id}`);
+    const response = await api.get(`/api/v1/users/${id}`);
+    return response.data;
+  }
+
+  static async updateUserProfile(
+    id: string,
+    data: Partial<Pick<User, 'first_name' | 'last_name' | 'time_zone' | 'ui_mode'>>
+  ): Promise<User> {
+    const response = await api.patch(`/api/v1/users/${id}/profile`, data);
     return response.data;
   }
 
   // Organization endpoints
   static async getOrganizations(): Promise<Organization[]> {
-    const response = await api.get('/api/organizations');
-    return response.data;
+    const response = await api.get('/api/v1/organizations', { params: { limit: 500 } });
+    return response.data.organizations;
   }
 
   static async getOrganization(id: string): Promise<Organization> {
-    const response = await api.get(`/api/organizations/${id}`);
+    const response = await api.get(`/api/v1/organizations/${id}`);
     return response.data;
   }
 
   static async createOrganization(data: CreateOrgRequest): Promise<Organization> {
-    const response = await api.post('/api/organizations', data);
+    const response = await api.post('/api/v1/organizations', data);
     return response.data;
   }
 
   static async updateOrganization(id: string, data: Partial<CreateOrgRequest>): Promise<Organization> {
-    const response = await api.put(`/api/organizations/${id}`, data);
+    const response = await api.put(`/api/v1/organizations/${id}`, data);
     return response.data;
   }
 
   static async deleteOrganization(id: string): Promise<void> {
-    await api.delete(`/api/organizations/${id}`);
+    await api.delete(`/api/v1/organizations/${id}`);
   }
 
   // Organization member endpoints
   static async getOrganizationMembers(organizationId: string): Promise<Member[]> {
-    const response = await api.get(`/api/organizations/${organizationId}/members`);
-    return response.data;
+    const response = await api.get(`/api/v1/organizations/${organizationId}/members`, { params: { limit: 500 } });
+    return response.data.members;
   }
 
   static async addOrganizationMember(organizationId: string, data: InviteUserRequest): Promise<void> {
-    await api.post(`/api/organizations/${organizationId}/members`, data);
+    await api.post(`/api/v1/organizations/${organizationId}/members`, data);
   }
 
   static async removeOrganizationMember(organizationId: string, userId: string): Promise<void> {
-    await api.delete(`/api/organizations/${organizationId}/members/${userId}`);
+    await api.delete(`/api/v1/organizations/${organizationId}/members/${userId}`);
   }
 
   static async updateMemberRole(organizationId: string, userId: string, data: UpdateMemberRoleRequest): Promise<Member> {
-    const response = await api.put(`/api/organizations/${organizationId}/members/${userId}/role`, data);
+    const response = await api.put(`/api/v1/organizations/${organizationId}/members/${userId}/role`, data);
     return response.data;
   }
 
@@ -16,7 +16,9 @@ export interface User {
   created_at: string;
   updated_at: string;
   last_login?: string;
+  last_logout?: string;
   verified: boolean;
+  can_create_organizations?: boolean;
   recovery_addresses?: RecoveryAddress[];
   verifiable_addresses?: VerifiableAddress[];
 }
@@ -0,0 +1,1403 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	client "github.com/ory/kratos-client-go"
+)
+
+const (
+	testOrgID   = "11111111-1111-1111-1111-111111111111"
+	testUserID  = "22222222-2222-2222-2222-222222222222"
+	testOwnerID = "33333333-3333-3333-3333-333333333333"
+)
+
+// newTestServer returns a Server on db whose Kratos clients talk to a fake
+// Kratos serving kratos. Background workers are not started.
+func newTestServer(t *testing.T, db *sql.DB, kratos http.Handler) *Server {
+	t.Helper()
+	fakeKratos := httptest.NewServer(kratos)
+	t.Cleanup(fakeKratos.Close)
+
+	kratosConfig := func() *client.Configuration {
+		conf := client.NewConfiguration()
+		conf.Servers = client.ServerConfigurations{{URL: fakeKratos.URL}}
+		return conf
+	}
+	return &Server{
+		kratosPublic: client.NewAPIClient(kratosConfig()),
+		kratosAdmin:  client.NewAPIClient(kratosConfig()),
+		db:           db,
+		cfg: &Config{
+			KratosPublicURL:    fakeKratos.URL,
+			KratosAdminURL:     fakeKratos.URL,
+			Version:            "v1",
+			DefaultOrgSettings: map[string]interface{}{},
+		},
+
+		lastBulkReinvite:  make(map[string]time.Time),
+		userLimiters:      make(map[string]*trackedLimiter),
+		ipLimiters:        make(map[string]*trackedLimiter),
+		orgRateLimitCache: make(map[string]cachedRateLimit),
+		hierarchyCache:    make(map[string]cachedHierarchy),
+		sessionCache:      make(map[string]cachedSession),
+		authAuditQueue:    make(chan AuthAuditEntry, authAuditQueueSize),
+		events:            NewEventBus(),
+	}
+}
+
+// withSession makes r look like it passed sessionMiddleware as userID, with
+// mux variables vars
+func withSession(r *http.Request, userID string, vars map[string]string) *http.Request {
+	session := &client.Session{Id: "session-" + userID, Identity: client.Identity{Id: userID}}
+	r = r.WithContext(context.WithValue(r.Context(), sessionKey, sessionResult{session: session}))
+	return mux.SetURLVars(r, vars)
+}
+
+// identityJSON is a Kratos identity as the admin API returns it
+func identityJSON(id, email, first, last string) string {
+	return fmt.Sprintf(`{"id": %q, "schema_id": "default", "schema_url": "https://kratos/schemas/default", "state": "active",
+		"traits": {"email": %q, "name": {"first": %q, "last": %q}}}`, id, email, first, last)
+}
+
+// userRow answers userByIDQuery
+func userRow(id, email, first, last string) fakeQuery {
+	now := time.Now()
+	return fakeQuery{
+		match: "SELECT id, email, first_name, last_name, time_zone",
+		columns: []string{"id", "email", "first_name", "last_name", "time_zone", "ui_mode", "can_create_organizations",
+			"created_at", "updated_at", "last_login", "last_logout"},
+		rows: [][]driver.Value{{id, email, first, last, "UTC", "light", false, now, now, nil, nil}},
+	}
+}
+
+func countRow(match string, n int64) fakeQuery {
+	return fakeQuery{match: match, columns: []string{"count"}, rows: [][]driver.Value{{n}}}
+}
+
+// membershipQueries answers the membership and permission lookups for a user
+// holding role in testOrg. An empty role means not a member.
+func membershipQueries(ownerID, role string, customPermissions []byte) []fakeQuery {
+	count := int64(0)
+	var roleValue driver.Value
+	if role != "" {
+		count = 1
+		roleValue = role
+	}
+	return []fakeQuery{
+		{match: "SELECT COUNT(*) FROM user_organization_links uol JOIN organizations", columns: []string{"count"}, rows: [][]driver.Value{{count}}},
+		{match: "SELECT o.owner_id, l.role, r.permissions", columns: []string{"owner_id", "role", "permissions"},
+			rows: [][]driver.Value{{ownerID, roleValue, customPermissions}}},
+	}
+}
+
+func TestComputeOrgPermissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		userID  string
+		role    string
+		custom  []byte
+		allowed []string
+	}{
+		{
+			name:   "non-member",
+			userID: testUserID,
+		},
+		{
+			name:    "member",
+			userID:  testUserID,
+			role:    "member",
+			allowed: []string{"view_org", "view_members"},
+		},
+		{
+			name:   "admin",
+			userID: testUserID,
+			role:   "admin",
+			allowed: []string{"view_org", "view_members", "update_org", "add_member", "remove_member", "update_member_role",
+				permManageMembers, permManageRoles, permViewAuditLog, permManageSettings},
+		},
+		{
+			name:   "owner",
+			userID: testOwnerID,
+			role:   "owner",
+			allowed: []string{"view_org", "view_members", "update_org", "add_member", "remove_member", "update_member_role",
+				permManageMembers, permManageRoles, permViewAuditLog, permManageSettings, permDeleteOrg},
+		},
+		{
+			name:    "custom role",
+			userID:  testUserID,
+			role:    "auditor",
+			custom:  []byte(`["view_audit_log"]`),
+			allowed: []string{"view_org", "view_members", permViewAuditLog},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := newFakeDB(t, membershipQueries(testOwnerID, tt.role, tt.custom)...)
+			s := &Server{db: db, cfg: &Config{}}
+
+			permissions := s.computeOrgPermissions(tt.userID, testOrgID)
+
+			want := make(map[string]bool)
+			for _, permission := range tt.allowed {
+				want[permission] = true
+			}
+			for permission, got := range permissions {
+				if got != want[permission] {
+					t.Errorf("%s = %v, want %v", permission, got, want[permission])
+				}
+			}
+			for permission := range want {
+				if _, ok := permissions[permission]; !ok {
+					t.Errorf("%s missing from result", permission)
+				}
+			}
+		})
+	}
+}
+
+// TestServerWithInjectedDB boots the full router on an injected database and
+// shuts it down again, as an example for handler integration tests
+func TestServerWithInjectedDB(t *testing.T) {
+	db, _ := newFakeDB(t)
+	cfg := &Config{Version: "v1", CleanupInterval: time.Hour, DefaultOrgSettings: map[string]interface{}{}}
+	s := NewServerWithDB(cfg, db)
+
+	ts := httptest.NewServer(s.setupRoutes())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/health")
+	if err != nil {
+		t.Fatalf("GET /health: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+	if body["status"] != "healthy" || body["database"] != "connected" {
+		t.Errorf("body = %v", body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
+
+func oidcProviderNode(provider string) string {
+	return fmt.Sprintf(`{"type": "input", "group": "oidc", "messages": [], "meta": {},
+		"attributes": {"node_type": "input", "name": "provider", "type": "submit", "value": %q, "disabled": false}}`, provider)
+}
+
+func TestGetAvailableProviders(t *testing.T) {
+	flowRequests := 0
+	kratos := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/self-service/login/api" {
+			http.NotFound(w, r)
+			return
+		}
+		flowRequests++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+			"id": "flow", "type": "api", "state": "choose_method", "request_url": "https://auth.example.com",
+			"issued_at": "2024-01-01T00:00:00Z", "expires_at": "2030-01-01T00:00:00Z",
+			"ui": {"action": "https://auth.example.com/self-service/login?flow=flow", "method": "POST", "nodes": [
+				%s,
+				%s,
+				{"type": "input", "group": "password", "messages": [], "meta": {},
+					"attributes": {"node_type": "input", "name": "identifier", "type": "text", "disabled": false}}
+			]}
+		}`, oidcProviderNode("google"), oidcProviderNode("github"))
+	})
+	s := newTestServer(t, nil, kratos)
+
+	providers, err := s.getAvailableProviders(context.Background())
+	if err != nil {
+		t.Fatalf("getAvailableProviders: %v", err)
+	}
+
+	want := []AuthProvider{
+		{Provider: "google", Label: "Google", LoginURL: "https://auth.example.com/self-service/login/browser"},
+		{Provider: "github", Label: "Github", LoginURL: "https://auth.example.com/self-service/login/browser"},
+	}
+	if fmt.Sprint(providers) != fmt.Sprint(want) {
+		t.Errorf("providers = %v, want %v", providers, want)
+	}
+
+	if _, err := s.getAvailableProviders(context.Background()); err != nil {
+		t.Fatalf("second getAvailableProviders: %v", err)
+	}
+	if flowRequests != 1 {
+		t.Errorf("Kratos asked %d times, want 1 (cached)", flowRequests)
+	}
+}
+
+func TestDeleteUserDryRun(t *testing.T) {
+	deletedInKratos := false
+	kratos := http.NewServeMux()
+	kratos.HandleFunc("/admin/identities/"+testUserID, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deletedInKratos = true
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, identityJSON(testUserID, "alice@example.com", "Alice", "Smith"))
+	})
+	kratos.HandleFunc("/admin/identities/"+testUserID+"/sessions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"id": "s1"}, {"id": "s2"}, {"id": "s3"}]`)
+	})
+
+	queries := func(ownedOrgs ...string) []fakeQuery {
+		owned := fakeQuery{match: "SELECT id FROM organizations WHERE owner_id", columns: []string{"id"}}
+		for _, org := range ownedOrgs {
+			owned.rows = append(owned.rows, []driver.Value{org})
+		}
+		return []fakeQuery{
+			userRow(testUserID, "alice@example.com", "Alice", "Smith"),
+			owned,
+			countRow("SELECT COUNT(*) FROM user_organization_links WHERE user_id", 2),
+			countRow("SELECT COUNT(*) FROM org_audit_log", 150),
+			{match: "DELETE FROM"},
+		}
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		db, fake := newFakeDB(t, queries(testOrgID)...)
+		s := newTestServer(t, db, kratos)
+
+		r := withSession(httptest.NewRequest("DELETE", "/users/"+testUserID+"?dry_run=true", nil), testUserID,
+			map[string]string{"id": testUserID})
+		w := httptest.NewRecorder()
+		s.deleteUser(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", w.Code, w.Body)
+		}
+		var body struct {
+			WouldDelete DeletionPreview `json:"would_delete"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		preview := body.WouldDelete
+		if preview.User == nil || preview.User.Email != "alice@example.com" {
+			t.Errorf("user = %+v", preview.User)
+		}
+		if fmt.Sprint(preview.OrganizationsAsSoleOwner) != fmt.Sprint([]string{testOrgID}) ||
+			preview.Memberships != 2 || preview.AuditLogEntries != 150 || preview.Sessions != 3 {
+			t.Errorf("preview = %+v", preview)
+		}
+		if fake.executed("DELETE") || deletedInKratos {
+			t.Error("dry run deleted data")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		db, fake := newFakeDB(t, queries()...)
+		s := newTestServer(t, db, kratos)
+
+		r := withSession(httptest.NewRequest("DELETE", "/users/"+testUserID, nil), testUserID,
+			map[string]string{"id": testUserID})
+		w := httptest.NewRecorder()
+		s.deleteUser(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", w.Code, w.Body)
+		}
+		if !fake.executed("DELETE FROM users") || !fake.executed("DELETE FROM user_organization_links") {
+			t.Error("local rows not deleted")
+		}
+		if !deletedInKratos {
+			t.Error("Kratos identity not deleted")
+		}
+	})
+	t.Run("owner", func(t *testing.T) {
+		deletedInKratos = false
+		db, fake := newFakeDB(t, queries(testOrgID)...)
+		s := newTestServer(t, db, kratos)
+
+		r := withSession(httptest.NewRequest("DELETE", "/users/"+testUserID, nil), testUserID,
+			map[string]string{"id": testUserID})
+		w := httptest.NewRecorder()
+		s.deleteUser(w, r)
+
+		if w.Code != http.StatusConflict {
+			t.Fatalf("status = %d, want 409 (body %s)", w.Code, w.Body)
+		}
+		var body struct {
+			Details struct {
+				OrganizationIDs []string `json:"organization_ids"`
+			} `json:"details"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(body.Details.OrganizationIDs) != fmt.Sprint([]string{testOrgID}) {
+			t.Errorf("organization_ids = %v, want [%s]", body.Details.OrganizationIDs, testOrgID)
+		}
+		if fake.executed("DELETE") || deletedInKratos {
+			t.Error("owner deleted, orphaning their organization")
+		}
+	})
+}
+
+func TestEraseUserDataLeavesOnlyAnonymousRecord(t *testing.T) {
+	kratos := http.NewServeMux()
+	kratos.HandleFunc("/admin/identities/"+testUserID, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, identityJSON(testUserID, "alice@example.com", "Alice", "Smith"))
+	})
+
+	db, fake := newFakeDB(t,
+		// Soft-deleted organizations are filtered out, so none are live
+		fakeQuery{match: "SELECT id FROM organizations WHERE owner_id = $1 AND deleted_at IS NULL", columns: []string{"id"}},
+		fakeQuery{match: "SELECT email FROM users", columns: []string{"email"}, rows: [][]driver.Value{{"alice@example.com"}}},
+		fakeQuery{match: "DELETE FROM"},
+		fakeQuery{match: "UPDATE"},
+		fakeQuery{match: "INSERT INTO data_erasure_log"},
+	)
+	s := newTestServer(t, db, kratos)
+
+	r := withSession(httptest.NewRequest("DELETE", "/users/"+testUserID+"/data", strings.NewReader(`{"confirm": true, "reason": "user_request"}`)),
+		testUserID, map[string]string{"id": testUserID})
+	w := httptest.NewRecorder()
+	s.eraseUserData(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusNoContent, w.Body)
+	}
+	for _, stmt := range []string{
+		"DELETE FROM privacy_audit_log WHERE subject_id",
+		"UPDATE privacy_audit_log SET actor_id = NULL",
+		"UPDATE organizations SET owner_id = NULL WHERE owner_id = $1 AND deleted_at IS NOT NULL",
+		"DELETE FROM users",
+	} {
+		if !fake.executed(stmt) {
+			t.Errorf("%s not run", stmt)
+		}
+	}
+}
+
+func TestCollectUserDataIncludesTokensPreferencesAndAuthLog(t *testing.T) {
+	now := time.Now()
+	db, _ := newFakeDB(t,
+		userRow(testUserID, "alice@example.com", "Alice", "Smith"),
+		fakeQuery{match: "FROM user_organization_links uol", columns: []string{"organization_id", "name", "role", "joined_at"}},
+		fakeQuery{match: "FROM team_members", columns: []string{"team_id", "name", "org_id", "role", "joined_at"}},
+		fakeQuery{match: "FROM api_keys", columns: []string{"id", "user_id", "name", "key_prefix", "created_at", "last_used_at", "expires_at", "revoked_at"}},
+		fakeQuery{match: "FROM personal_access_tokens", columns: []string{"id", "user_id", "name", "prefix", "scopes", "expires_at", "last_used_at", "created_at"},
+			rows: [][]driver.Value{{"token", testUserID, "CI", "userms_pat_abcdefgh", []byte("{read}"), nil, nil, now}}},
+		fakeQuery{match: "FROM notification_preferences", columns: []string{"event_type", "channel", "enabled", "updated_at"}},
+		fakeQuery{match: "FROM audit_auth_log", columns: []string{"id", "user_id", "event_type", "ip_address", "user_agent", "session_id", "success", "error_message", "created_at"},
+			rows: [][]driver.Value{{"event", testUserID, "login", "203.0.113.7", "curl", nil, true, nil, now}}},
+		fakeQuery{match: "FROM invitations", columns: []string{"id", "organization_id", "email", "role", "status", "expires_at", "last_sent_at", "created_by", "created_at", "used_at"}},
+		fakeQuery{match: "FROM org_audit_log", columns: []string{"id", "org_id", "actor_id", "action", "target_user_id", "metadata", "created_at"}},
+	)
+	s := newTestServer(t, db, http.NotFoundHandler())
+
+	export, err := s.collectUserData(testUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens := export["personal_access_tokens"].([]PersonalAccessToken); len(tokens) != 1 || tokens[0].Prefix != "userms_pat_abcdefgh" {
+		t.Errorf("personal_access_tokens = %+v, want the one token", tokens)
+	}
+	if prefs := export["notification_preferences"].([]NotificationPreference); len(prefs) == 0 {
+		t.Error("notification_preferences missing")
+	}
+	if events := export["audit_auth_log"].([]AuthAuditEntry); len(events) != 1 || events[0].IPAddress != "203.0.113.7" {
+		t.Errorf("audit_auth_log = %+v, want the one login", events)
+	}
+}
+
+func TestGetEffectiveOrgSettings(t *testing.T) {
+	queries := append(membershipQueries(testOwnerID, "member", nil),
+		fakeQuery{match: "SELECT settings FROM org_settings", columns: []string{"settings"},
+			rows: [][]driver.Value{{[]byte(`{"mfa_required": true}`)}}},
+	)
+	db, _ := newFakeDB(t, queries...)
+	s := newTestServer(t, db, http.NotFoundHandler())
+	s.cfg.DefaultOrgSettings = map[string]interface{}{"mfa_required": false, "session_timeout_minutes": float64(60)}
+
+	r := withSession(httptest.NewRequest("GET", "/organizations/"+testOrgID+"/settings/effective", nil), testUserID,
+		map[string]string{"id": testOrgID})
+	w := httptest.NewRecorder()
+	s.getEffectiveOrgSettings(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var effective map[string]EffectiveSetting
+	if err := json.NewDecoder(w.Body).Decode(&effective); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]EffectiveSetting{
+		"mfa_required":            {Value: true, Source: "org"},
+		"session_timeout_minutes": {Value: float64(60), Source: "default"},
+	}
+	if fmt.Sprint(effective) != fmt.Sprint(want) {
+		t.Errorf("effective = %v, want %v", effective, want)
+	}
+}
+
+// memberRows answers getOrgMembers with one member per user ID
+func memberRows(userIDs ...string) fakeQuery {
+	query := fakeQuery{
+		match:   "SELECT uol.user_id, uol.role, uol.joined_at",
+		columns: []string{"user_id", "role", "joined_at", "email", "first_name", "last_name", "last_login", "metadata"},
+	}
+	for i, id := range userIDs {
+		query.rows = append(query.rows, []driver.Value{id, "member", time.Now(), fmt.Sprintf("user%d@example.com", i),
+			"User", fmt.Sprint(i), nil, []byte("{}")})
+	}
+	return query
+}
+
+func TestSyncOrgMembersFromKratos(t *testing.T) {
+	const orphanID = "44444444-4444-4444-4444-444444444444"
+
+	checked := map[string]bool{}
+	kratos := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Path[len("/admin/identities/"):]
+		checked[id] = true
+		w.Header().Set("Content-Type", "application/json")
+		if id == orphanID {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": {"code": 404, "message": "Unable to locate the resource"}}`)
+			return
+		}
+		fmt.Fprint(w, identityJSON(id, "user0@example.com", "User", "0"))
+	})
+
+	db, fake := newFakeDB(t,
+		memberRows(testUserID, orphanID),
+		fakeQuery{match: "DELETE FROM user_organization_links", columns: []string{"organization_id"},
+			rows: [][]driver.Value{{testOrgID}}},
+		fakeQuery{match: "DELETE FROM"},
+		fakeQuery{match: "INSERT INTO org_audit_log"},
+		fakeQuery{match: "FROM webhooks", columns: []string{"id", "org_id", "url", "secret", "events", "is_active", "created_at"},
+			rows: [][]driver.Value{{"hook", testOrgID, "https://example.com/hook", "secret", "{member.removed}", true, time.Now()}}},
+	)
+	s := newTestServer(t, db, kratos)
+	s.cfg.SystemAdminIDs = []string{testOwnerID}
+	s.webhookQueue = make(chan webhookJob, 1)
+	s.cacheHierarchy(testUserID, []OrgNode{{ID: testOrgID}})
+	s.cacheHierarchy(orphanID, []OrgNode{{ID: testOrgID}})
+
+	r := withSession(httptest.NewRequest("POST", "/organizations/"+testOrgID+"/sync-members-from-kratos", nil), testOwnerID,
+		map[string]string{"id": testOrgID})
+	w := httptest.NewRecorder()
+	s.syncOrgMembersFromKratos(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var body struct {
+		Removed int                 `json:"removed_orphaned_members"`
+		Details []map[string]string `json:"details"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	if !checked[testUserID] || !checked[orphanID] {
+		t.Errorf("checked identities %v, want both members", checked)
+	}
+	if body.Removed != 1 || len(body.Details) != 1 || body.Details[0]["user_id"] != orphanID {
+		t.Errorf("response = %+v, want only %s removed", body, orphanID)
+	}
+	if !fake.executed("DELETE FROM user_organization_links") || !fake.executed("DELETE FROM users") {
+		t.Error("orphan rows not deleted")
+	}
+	if _, ok := s.hierarchyCache[orphanID]; ok {
+		t.Error("removed member's hierarchy still cached")
+	}
+	if _, ok := s.hierarchyCache[testUserID]; !ok {
+		t.Error("remaining member's hierarchy was dropped")
+	}
+
+	select {
+	case job := <-s.webhookQueue:
+		if job.event != webhookEventMemberRemoved || !strings.Contains(string(job.payload), orphanID) {
+			t.Errorf("webhook job = %s %s, want member.removed for %s", job.event, job.payload, orphanID)
+		}
+	case <-time.After(time.Second):
+		t.Error("no member.removed webhook queued for the orphan")
+	}
+}
+
+func TestHierarchyCache(t *testing.T) {
+	const otherID = "44444444-4444-4444-4444-444444444444"
+	s := newTestServer(t, nil, http.NotFoundHandler())
+
+	// A full cache sweeps expired entries before adding another
+	for i := 0; i < hierarchyCacheSweepSize; i++ {
+		s.hierarchyCache[fmt.Sprintf("expired-%d", i)] = cachedHierarchy{fetchedAt: time.Now().Add(-hierarchyCacheTTL)}
+	}
+	s.cacheHierarchy(testUserID, []OrgNode{{ID: testOrgID}})
+	s.cacheHierarchy(otherID, []OrgNode{{ID: testOrgID}})
+	if len(s.hierarchyCache) != 2 {
+		t.Fatalf("cache holds %d entries after the sweep, want 2", len(s.hierarchyCache))
+	}
+
+	s.invalidateHierarchies(testUserID)
+	if _, ok := s.hierarchyCache[testUserID]; ok {
+		t.Error("invalidated hierarchy still cached")
+	}
+	if _, ok := s.hierarchyCache[otherID]; !ok {
+		t.Error("invalidating one user dropped another's hierarchy")
+	}
+
+	s.clearHierarchies()
+	if len(s.hierarchyCache) != 0 {
+		t.Errorf("cache holds %d entries after clearing, want 0", len(s.hierarchyCache))
+	}
+}
+
+// memberDirectory answers getOrgMembersFiltered by applying its role and
+// search conditions to members
+// ilikeContains reports whether s ILIKE '%' || pattern || '%', with the
+// default backslash escape
+func ilikeContains(s, pattern string) bool {
+	expr := "(?is)"
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			expr += regexp.QuoteMeta(string(r))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			expr += ".*"
+		case r == '_':
+			expr += "."
+		default:
+			expr += regexp.QuoteMeta(string(r))
+		}
+	}
+	return regexp.MustCompile(expr).MatchString(s)
+}
+
+func memberDirectory(members []Member) []fakeQuery {
+	filter := func(query string, args []driver.Value) []Member {
+		next := 1
+		role, search := "", ""
+		if strings.Contains(query, "uol.role = $") {
+			role = args[next].(string)
+			next++
+		}
+		if strings.Contains(query, "ILIKE") {
+			search = args[next].(string)
+		}
+
+		var matched []Member
+		for _, m := range members {
+			if role != "" && m.Role != role {
+				continue
+			}
+			if search != "" && !ilikeContains(m.Email, search) && !ilikeContains(m.FirstName, search) && !ilikeContains(m.LastName, search) {
+				continue
+			}
+			matched = append(matched, m)
+		}
+		return matched
+	}
+
+	return []fakeQuery{
+		{match: "SELECT COUNT(*) FROM user_organization_links uol LEFT JOIN users u", columns: []string{"count"},
+			respond: func(query string, args []driver.Value) [][]driver.Value {
+				return [][]driver.Value{{int64(len(filter(query, args)))}}
+			}},
+		{match: "SELECT uol.user_id, uol.role, uol.joined_at",
+			columns: []string{"user_id", "role", "joined_at", "email", "first_name", "last_name", "last_login", "metadata"},
+			respond: func(query string, args []driver.Value) [][]driver.Value {
+				var rows [][]driver.Value
+				for _, m := range filter(query, args) {
+					rows = append(rows, []driver.Value{m.UserID, m.Role, m.JoinedAt, m.Email, m.FirstName, m.LastName, nil,
+						[]byte("{}")})
+				}
+				return rows
+			}},
+	}
+}
+
+func TestGetMembersSearch(t *testing.T) {
+	names := []string{"Alice", "Bob", "Carol", "Dave", "Erin", "Frank", "Grace", "Heidi", "Ivan", "Judy"}
+	var members []Member
+	for i, name := range names {
+		role := "member"
+		if i%2 == 1 {
+			role = "admin"
+		}
+		members = append(members, Member{
+			UserID:    fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			Role:      role,
+			JoinedAt:  time.Now(),
+			Email:     strings.ToLower(name) + "@example.com",
+			FirstName: name,
+			LastName:  "Smith",
+		})
+	}
+	members[9].Email = "judy_smith@example.com"
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"search", "?search=alice", []string{"Alice"}},
+		{"search is case insensitive", "?search=ALI", []string{"Alice"}},
+		{"empty search", "?search=", names},
+		{"search with role", "?search=d&role=admin", []string{"Dave", "Heidi", "Judy"}},
+		{"no match", "?search=zed", nil},
+		{"percent is literal", "?search=%25", nil},
+		{"underscore is literal", "?search=_", []string{"Judy"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := newFakeDB(t, append(membershipQueries(testOwnerID, "member", nil), memberDirectory(members)...)...)
+			s := newTestServer(t, db, http.NotFoundHandler())
+
+			r := withSession(httptest.NewRequest("GET", "/organizations/"+testOrgID+"/members"+tt.query, nil), testUserID,
+				map[string]string{"id": testOrgID})
+			w := httptest.NewRecorder()
+			s.getMembers(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", w.Code, w.Body)
+			}
+			var body struct {
+				Members []Member `json:"members"`
+				Total   int      `json:"total"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, m := range body.Members {
+				got = append(got, m.FirstName)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") || body.Total != len(tt.want) {
+				t.Errorf("members = %v (total %d), want %v", got, body.Total, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportMembersContentNegotiation(t *testing.T) {
+	tests := []struct {
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"", http.StatusOK, "application/json"},
+		{"application/json", http.StatusOK, "application/json"},
+		{"text/csv", http.StatusOK, "text/csv"},
+		{"application/json;q=0.5, text/csv", http.StatusOK, "text/csv"},
+		{"application/xml", http.StatusNotAcceptable, "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			db, _ := newFakeDB(t, append(membershipQueries(testOwnerID, "admin", nil), memberRows(testUserID))...)
+			s := newTestServer(t, db, http.NotFoundHandler())
+			handler := contentNegotiation([]string{"application/json", "text/csv"})(http.HandlerFunc(s.exportMembers))
+
+			r := withSession(httptest.NewRequest("GET", "/organizations/"+testOrgID+"/members/export", nil), testOwnerID,
+				map[string]string{"id": testOrgID})
+			r.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.status, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if tt.contentType == "text/csv" && !strings.HasPrefix(w.Body.String(), "user_id,email,") {
+				t.Errorf("body is not CSV: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestAdminUpdateTraits(t *testing.T) {
+	// fakeKratos serves the identity and, like Kratos, rejects updates
+	// missing the schema's required name.first
+	var kratosTraits map[string]interface{}
+	kratos := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPut {
+			var body struct {
+				Traits map[string]interface{} `json:"traits"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			name, _ := body.Traits["name"].(map[string]interface{})
+			if _, ok := name["first"]; !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": {"code": 400, "message": "name.first is required"}}`)
+				return
+			}
+			kratosTraits = body.Traits
+			name, _ = kratosTraits["name"].(map[string]interface{})
+			fmt.Fprint(w, identityJSON(testUserID, kratosTraits["email"].(string), name["first"].(string), name["last"].(string)))
+			return
+		}
+		fmt.Fprint(w, identityJSON(testUserID, "alice@example.com", "Alice", "Smith"))
+	})
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"update first name", `{"traits": {"name": {"first": "Alicia"}}}`, http.StatusOK},
+		{"remove required email", `{"traits": {"email": null}}`, http.StatusUnprocessableEntity},
+		{"remove required first name", `{"traits": {"name": {"first": null}}}`, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kratosTraits = nil
+			var updated []driver.Value
+			db, fake := newFakeDB(t,
+				fakeQuery{match: "UPDATE users SET email = $1, first_name = $2, last_name = $3",
+					respond: func(query string, args []driver.Value) [][]driver.Value {
+						updated = args
+						return [][]driver.Value{{}}
+					}},
+				userRow(testUserID, "alice@example.com", "Alicia", "Smith"),
+			)
+			s := newTestServer(t, db, kratos)
+			s.cfg.SystemAdminIDs = []string{testOwnerID}
+
+			r := withSession(httptest.NewRequest("PATCH", "/admin/users/"+testUserID+"/traits", strings.NewReader(tt.body)),
+				testOwnerID, map[string]string{"id": testUserID})
+			w := httptest.NewRecorder()
+			s.adminUpdateTraits(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				if fake.executed("UPDATE users") {
+					t.Error("local user updated after a rejected trait change")
+				}
+				return
+			}
+
+			name, _ := kratosTraits["name"].(map[string]interface{})
+			if name["first"] != "Alicia" || name["last"] != "Smith" || kratosTraits["email"] != "alice@example.com" {
+				t.Errorf("Kratos traits = %v, want first name changed and the rest kept", kratosTraits)
+			}
+			if fmt.Sprint(updated) != fmt.Sprint([]driver.Value{"alice@example.com", "Alicia", "Smith", testUserID}) {
+				t.Errorf("local update args = %v", updated)
+			}
+			var user User
+			if err := json.NewDecoder(w.Body).Decode(&user); err != nil {
+				t.Fatal(err)
+			}
+			if user.FirstName != "Alicia" {
+				t.Errorf("response first name = %q, want Alicia", user.FirstName)
+			}
+		})
+	}
+}
+
+func TestCachedOrgRateLimit(t *testing.T) {
+	// The user is a member of two organizations with these limits
+	limits := []int64{100, 200}
+	db, _ := newFakeDB(t, fakeQuery{match: "SELECT MIN(os.api_rate_limit_rpm)", columns: []string{"min"},
+		respond: func(query string, args []driver.Value) [][]driver.Value {
+			lowest := limits[0]
+			for _, limit := range limits[1:] {
+				if limit < lowest {
+					lowest = limit
+				}
+			}
+			return [][]driver.Value{{lowest}}
+		}})
+	s := newTestServer(t, db, http.NotFoundHandler())
+
+	if limit := s.cachedOrgRateLimit(testUserID); limit == nil || *limit != 100 {
+		t.Fatalf("limit = %v, want the lower limit 100", limit)
+	}
+
+	limits[0] = 50
+	if limit := s.cachedOrgRateLimit(testUserID); limit == nil || *limit != 100 {
+		t.Errorf("limit = %v, want cached 100 before the TTL passes", limit)
+	}
+
+	s.rateLimitMu.Lock()
+	cached := s.orgRateLimitCache[testUserID]
+	cached.fetchedAt = time.Now().Add(-orgRateLimitCacheTTL)
+	s.orgRateLimitCache[testUserID] = cached
+	s.rateLimitMu.Unlock()
+
+	if limit := s.cachedOrgRateLimit(testUserID); limit == nil || *limit != 50 {
+		t.Errorf("limit = %v, want the changed limit 50 once the cache expired", limit)
+	}
+}
+
+func TestCreateInvitationUsesOrgSettings(t *testing.T) {
+	settings := []byte(`{"require_email_domain": "example.com", "default_role": "admin", "invitation_ttl_hours": 24}`)
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"email outside the required domain", `{"email": "bob@elsewhere.com"}`, http.StatusBadRequest},
+		{"default role and lifetime", `{"email": "bob@example.com"}`, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var role string
+			var expiresAt time.Time
+			db, fake := newFakeDB(t, append(membershipQueries(testUserID, "admin", nil),
+				fakeQuery{match: "SELECT settings FROM org_settings", columns: []string{"settings"}, rows: [][]driver.Value{{settings}}},
+				fakeQuery{match: "INSERT INTO invitations", columns: []string{"id", "expires_at", "last_sent_at", "created_at"},
+					respond: func(query string, args []driver.Value) [][]driver.Value {
+						role, expiresAt = args[2].(string), args[4].(time.Time)
+						return [][]driver.Value{{"invitation", expiresAt, time.Now(), time.Now()}}
+					}},
+				fakeQuery{match: "INSERT INTO org_audit_log"},
+				fakeQuery{match: "FROM organizations"},
+				fakeQuery{match: "FROM users"},
+			)...)
+			s := newTestServer(t, db, http.NotFoundHandler())
+
+			r := withSession(httptest.NewRequest("POST", "/organizations/"+testOrgID+"/invitations", strings.NewReader(tt.body)),
+				testUserID, map[string]string{"id": testOrgID})
+			w := httptest.NewRecorder()
+			s.createInvitation(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusCreated {
+				if fake.executed("INSERT INTO invitations") {
+					t.Error("invitation created outside the required domain")
+				}
+				return
+			}
+			if role != "admin" {
+				t.Errorf("role = %q, want the default role admin", role)
+			}
+			if ttl := time.Until(expiresAt); ttl < 23*time.Hour || ttl > 24*time.Hour {
+				t.Errorf("invitation expires in %v, want 24h", ttl)
+			}
+		})
+	}
+}
+
+func TestResendAllPendingInvitations(t *testing.T) {
+	type invitation struct {
+		id, email  string
+		lastSentAt time.Time
+	}
+	pending := []*invitation{
+		{"inv-1", "old1@example.com", time.Now().Add(-48 * time.Hour)},
+		{"inv-2", "recent@example.com", time.Now().Add(-10 * time.Minute)},
+		{"inv-3", "old2@example.com", time.Now().Add(-2 * time.Hour)},
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+
+	queries := append(membershipQueries(testOwnerID, "admin", nil),
+		fakeQuery{match: "SELECT settings FROM org_settings", columns: []string{"settings"}},
+		fakeQuery{match: "SELECT COUNT(*) FROM invitations", columns: []string{"count"},
+			respond: func(query string, args []driver.Value) [][]driver.Value {
+				recent := int64(0)
+				for _, inv := range pending {
+					if !inv.lastSentAt.Before(hourAgo) {
+						recent++
+					}
+				}
+				return [][]driver.Value{{recent}}
+			}},
+		fakeQuery{match: "UPDATE invitations", columns: []string{"id", "email", "role", "token", "expires_at"},
+			respond: func(query string, args []driver.Value) [][]driver.Value {
+				var rows [][]driver.Value
+				for _, inv := range pending {
+					if inv.lastSentAt.Before(hourAgo) {
+						inv.lastSentAt = time.Now()
+						rows = append(rows, []driver.Value{inv.id, inv.email, "member", "token-" + inv.id,
+							time.Now().Add(invitationTTL)})
+					}
+				}
+				return rows
+			}},
+		fakeQuery{match: "INSERT INTO org_audit_log"},
+		fakeQuery{match: "FROM organizations WHERE id = $1", columns: []string{"id"}},
+		fakeQuery{match: "SELECT id FROM users WHERE lower(email)", columns: []string{"id"}},
+	)
+	db, fake := newFakeDB(t, queries...)
+	s := newTestServer(t, db, http.NotFoundHandler())
+	const otherOrgID = "44444444-4444-4444-4444-444444444444"
+	s.lastBulkReinvite[otherOrgID] = time.Now().Add(-bulkReinviteInterval)
+
+	resend := func() *httptest.ResponseRecorder {
+		r := withSession(httptest.NewRequest("POST", "/organizations/"+testOrgID+"/invitations/resend", nil), testOwnerID,
+			map[string]string{"id": testOrgID})
+		w := httptest.NewRecorder()
+		s.resendAllPendingInvitations(w, r)
+		return w
+	}
+
+	w := resend()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var body map[string]int
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body["resent_count"] != 2 || body["skipped_recently_sent"] != 1 {
+		t.Errorf("response = %v, want 2 resent and 1 skipped", body)
+	}
+	if !fake.executed("INSERT INTO org_audit_log") {
+		t.Error("resend not audited")
+	}
+	if _, ok := s.lastBulkReinvite[otherOrgID]; ok {
+		t.Error("expired throttle entry of another organization kept")
+	}
+
+	if w := resend(); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("immediate second resend: status = %d, Retry-After %q, want throttled",
+			w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestResendAllPendingInvitationsFailureDoesNotThrottle(t *testing.T) {
+	queries := append(membershipQueries(testOwnerID, "admin", nil),
+		fakeQuery{match: "SELECT settings FROM org_settings", columns: []string{"settings"}},
+		fakeQuery{match: "SELECT COUNT(*) FROM invitations", err: fmt.Errorf("connection reset")})
+	db, _ := newFakeDB(t, queries...)
+	s := newTestServer(t, db, http.NotFoundHandler())
+
+	r := withSession(httptest.NewRequest("POST", "/organizations/"+testOrgID+"/invitations/resend", nil), testOwnerID,
+		map[string]string{"id": testOrgID})
+	w := httptest.NewRecorder()
+	s.resendAllPendingInvitations(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusInternalServerError, w.Body)
+	}
+	if _, ok := s.lastBulkReinvite[testOrgID]; ok {
+		t.Error("failed resend started the throttle interval")
+	}
+}
+
+func TestUserIDsByEmail(t *testing.T) {
+	const kratosUserID = "55555555-5555-5555-5555-555555555555"
+
+	var lookedUp []string
+	kratos := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email := r.URL.Query().Get("credentials_identifier")
+		lookedUp = append(lookedUp, email)
+		w.Header().Set("Content-Type", "application/json")
+		if email == "bob@example.com" {
+			fmt.Fprint(w, "["+identityJSON(kratosUserID, email, "Bob", "Jones")+"]")
+			return
+		}
+		fmt.Fprint(w, "[]")
+	})
+
+	db, fake := newFakeDB(t,
+		fakeQuery{match: "SELECT id, LOWER(email) FROM users WHERE LOWER(email) = ANY($1)", columns: []string{"id", "email"},
+			rows: [][]driver.Value{{testUserID, "alice@example.com"}}},
+		fakeQuery{match: "INSERT INTO users"},
+	)
+	s := newTestServer(t, db, kratos)
+
+	ids, err := s.userIDsByEmail(context.Background(),
+		[]string{"Alice@Example.com", "bob@example.com", "carol@example.com", "CAROL@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"alice@example.com": testUserID, "bob@example.com": kratosUserID}
+	if fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("ids = %v, want %v", ids, want)
+	}
+	if fmt.Sprint(lookedUp) != "[bob@example.com carol@example.com]" {
+		t.Errorf("Kratos lookups = %v, want only the emails missing locally, once each", lookedUp)
+	}
+	if !fake.executed("INSERT INTO users") {
+		t.Error("user found in Kratos not saved locally")
+	}
+}
+
+func TestUpdateOrgRoleLimitsPermissions(t *testing.T) {
+	const roleID = "44444444-4444-4444-4444-444444444444"
+	tests := []struct {
+		name        string
+		userID      string
+		role        string
+		custom      []byte
+		editedRole  string
+		permissions string
+		status      int
+	}{
+		{"custom role edits its own role", testUserID, "manager", []byte(`["manage_roles"]`),
+			"manager", `["manage_roles", "delete_org"]`, http.StatusForbidden},
+		{"custom role edits its own role without escalating", testUserID, "manager", []byte(`["manage_roles"]`),
+			"manager", `["manage_roles"]`, http.StatusForbidden},
+		{"admin grants delete_org", testUserID, "admin", nil,
+			"auditor", `["view_audit_log", "delete_org"]`, http.StatusForbidden},
+		{"admin grants what it holds", testUserID, "admin", nil,
+			"auditor", `["view_audit_log"]`, http.StatusOK},
+		{"owner grants delete_org", testOwnerID, "owner", nil,
+			"auditor", `["view_audit_log", "delete_org"]`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := append(membershipQueries(testOwnerID, tt.role, tt.custom),
+				fakeQuery{match: "SELECT name FROM org_roles WHERE id", columns: []string{"name"},
+					rows: [][]driver.Value{{tt.editedRole}}},
+				fakeQuery{match: "UPDATE org_roles SET name", columns: []string{"created_at"},
+					rows: [][]driver.Value{{time.Now()}}},
+				fakeQuery{match: "INSERT INTO org_audit_log", rows: [][]driver.Value{{}}},
+			)
+			db, fake := newFakeDB(t, queries...)
+			s := newTestServer(t, db, http.NotFoundHandler())
+
+			body := fmt.Sprintf(`{"name": %q, "permissions": %s}`, tt.editedRole, tt.permissions)
+			r := withSession(httptest.NewRequest("PUT", "/api/organizations/"+testOrgID+"/roles/"+roleID, strings.NewReader(body)),
+				tt.userID, map[string]string{"id": testOrgID, "roleId": roleID})
+			w := httptest.NewRecorder()
+			s.updateOrgRole(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.status, w.Body)
+			}
+			if updated := fake.executed("UPDATE org_roles"); updated != (tt.status == http.StatusOK) {
+				t.Errorf("role updated = %t, want %t", updated, tt.status == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestEscapeLikePattern(t *testing.T) {
+	tests := map[string]string{
+		"alice":     "alice",
+		"100%":      `100\%`,
+		"a_b":       `a\_b`,
+		`back\path`: `back\\path`,
+		`%_\`:       `\%\_\\`,
+	}
+	for in, want := range tests {
+		if got := escapeLikePattern(in); got != want {
+			t.Errorf("escapeLikePattern(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestUserOrganizationsFilterEscapesSearch(t *testing.T) {
+	where, args := userOrganizationsFilter(testUserID, OrgFilter{Search: "50%_off"})
+	if !strings.Contains(where, "o.name ILIKE") {
+		t.Fatalf("where = %q, want a name search", where)
+	}
+	if got := args[len(args)-1]; got != `50\%\_off` {
+		t.Errorf("search argument = %q, want wildcards escaped", got)
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	now := time.Now()
+	userColumns := []string{"id", "email", "first_name", "last_name", "time_zone", "ui_mode", "can_create_organizations",
+		"created_at", "updated_at", "last_login", "last_logout"}
+
+	tests := []struct {
+		name   string
+		userID string
+		query  string
+		status int
+		next   string
+	}{
+		{"not a system admin", testUserID, "", http.StatusForbidden, ""},
+		{"page number", testOwnerID, "?page=2", http.StatusBadRequest, ""},
+		{"search first page", testOwnerID, "?search=50%25_off&limit=1", http.StatusOK, "1"},
+		{"search last page", testOwnerID, "?search=50%25_off&limit=1&page_token=1", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var searched []driver.Value
+			db, _ := newFakeDB(t,
+				fakeQuery{match: "AND is_system_admin", columns: []string{"exists"}, rows: [][]driver.Value{{false}}},
+				countRow("SELECT COUNT(*) FROM users WHERE", 2),
+				fakeQuery{match: "FROM users WHERE email ILIKE", columns: userColumns,
+					respond: func(query string, args []driver.Value) [][]driver.Value {
+						searched = args
+						return [][]driver.Value{{testUserID, "50%_off@example.com", "Alice", "Smith", "UTC", "light", false, now, now, nil, nil}}
+					}},
+				fakeQuery{match: "JOIN user_organization_links uol ON o.id = uol.organization_id",
+					columns: []string{"id", "name", "org_type", "role", "joined_at"}},
+			)
+			s := newTestServer(t, db, http.NotFoundHandler())
+			s.cfg.SystemAdminIDs = []string{testOwnerID}
+
+			r := withSession(httptest.NewRequest("GET", "/api/users"+tt.query, nil), tt.userID, nil)
+			w := httptest.NewRecorder()
+			s.listUsers(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			if len(searched) == 0 || searched[0] != `50\%\_off` {
+				t.Errorf("search args = %v, want the wildcards escaped", searched)
+			}
+			var body struct {
+				Users         []User `json:"users"`
+				Total         int    `json:"total"`
+				NextPageToken string `json:"next_page_token"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Users) != 1 || body.Total != 2 || body.NextPageToken != tt.next {
+				t.Errorf("got %d users, total %d, next %q; want 1, 2, %q", len(body.Users), body.Total, body.NextPageToken, tt.next)
+			}
+		})
+	}
+}
+
+func TestLeaveOrganizationDeleteIfLastNeedsDeleteOrg(t *testing.T) {
+	// The caller is the only linked member but an admin, not the owner
+	queries := append(membershipQueries(testOwnerID, "admin", nil),
+		countRow("SELECT COUNT(*) FROM user_organization_links WHERE organization_id", 1))
+	db, fake := newFakeDB(t, queries...)
+	s := newTestServer(t, db, http.NotFoundHandler())
+
+	r := withSession(httptest.NewRequest("POST", "/organizations/"+testOrgID+"/leave?delete_if_last=true", nil),
+		testUserID, map[string]string{"id": testOrgID})
+	w := httptest.NewRecorder()
+	s.leaveOrganization(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusForbidden, w.Body)
+	}
+	if fake.executed("UPDATE organizations SET deleted_at") {
+		t.Error("organization deleted without delete_org")
+	}
+}
+
+// adminCounts answers countOrgAdminsTx with before, then after for every
+// later count
+func adminCounts(before, after int64) []fakeQuery {
+	counted := false
+	return []fakeQuery{
+		{match: "SELECT id FROM organizations WHERE id = $1 FOR UPDATE"},
+		{match: "SELECT COUNT(*) FROM user_organization_links l JOIN organizations o", columns: []string{"count"},
+			respond: func(string, []driver.Value) [][]driver.Value {
+				if counted {
+					return [][]driver.Value{{after}}
+				}
+				counted = true
+				return [][]driver.Value{{before}}
+			}},
+	}
+}
+
+func TestLeaveOrganizationLastAdmin(t *testing.T) {
+	queries := append(membershipQueries(testOwnerID, "admin", nil),
+		countRow("SELECT COUNT(*) FROM user_organization_links WHERE organization_id", 2),
+		fakeQuery{match: "SELECT owner_id FROM organizations", columns: []string{"owner_id"}, rows: [][]driver.Value{{testOwnerID}}},
+		fakeQuery{match: "DELETE FROM user_organization_links", rows: [][]driver.Value{{}}},
+	)
+	db, fake := newFakeDB(t, append(queries, adminCounts(1, 0)...)...)
+	s := newTestServer(t, db, http.NotFoundHandler())
+
+	r := withSession(httptest.NewRequest("POST", "/organizations/"+testOrgID+"/leave", nil),
+		testUserID, map[string]string{"id": testOrgID})
+	w := httptest.NewRecorder()
+	s.leaveOrganization(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusBadRequest, w.Body)
+	}
+	if fake.executed("INSERT INTO org_audit_log") {
+		t.Error("last admin recorded as having left")
+	}
+}
+
+func TestEscapeCSVRow(t *testing.T) {
+	tests := map[string]string{
+		"":                     "",
+		"Alice":                "Alice",
+		"alice@example.com":    "alice@example.com",
+		"=HYPERLINK(\"x\")":    "'=HYPERLINK(\"x\")",
+		"+1 555":               "'+1 555",
+		"-2+3":                 "'-2+3",
+		"@SUM(A1)":             "'@SUM(A1)",
+		"\tcmd":                "'\tcmd",
+		"\rcmd":                "'\rcmd",
+		"2026-10-16T00:00:00Z": "2026-10-16T00:00:00Z",
+	}
+	for in, want := range tests {
+		if got := escapeCSVRow([]string{in})[0]; got != want {
+			t.Errorf("escapeCSVRow(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestPatchOrganizationReparent(t *testing.T) {
+	const parentID = "44444444-4444-4444-4444-444444444444"
+	tests := []struct {
+		name         string
+		parentExists bool
+		status       int
+	}{
+		{"unknown parent", false, http.StatusNotFound},
+		{"parent the caller does not administer", true, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, fake := newFakeDB(t,
+				// The caller is admin of the organization but not a member of the parent
+				fakeQuery{match: "SELECT o.owner_id, l.role, r.permissions", columns: []string{"owner_id", "role", "permissions"},
+					respond: func(query string, args []driver.Value) [][]driver.Value {
+						if args[1] == testOrgID {
+							return [][]driver.Value{{testOwnerID, "admin", nil}}
+						}
+						return [][]driver.Value{{testOwnerID, nil, nil}}
+					}},
+				fakeQuery{match: "SELECT org_id, org_type FROM organizations", columns: []string{"org_id", "org_type"}, rows: [][]driver.Value{{nil, "organization"}}},
+				fakeQuery{match: "SELECT EXISTS(SELECT 1 FROM organizations WHERE id = $1 AND deleted_at IS NULL)",
+					columns: []string{"exists"}, rows: [][]driver.Value{{tt.parentExists}}},
+			)
+			s := newTestServer(t, db, http.NotFoundHandler())
+
+			r := withSession(httptest.NewRequest("PATCH", "/organizations/"+testOrgID, strings.NewReader(`{"org_id": "`+parentID+`"}`)),
+				testUserID, map[string]string{"id": testOrgID})
+			w := httptest.NewRecorder()
+			s.patchOrganization(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.status, w.Body)
+			}
+			if fake.executed("UPDATE organizations") {
+				t.Error("organization re-parented")
+			}
+		})
+	}
+}
+
+func TestUpdateOrganizationReparent(t *testing.T) {
+	const parentID = "44444444-4444-4444-4444-444444444444"
+	tests := []struct {
+		name         string
+		parentExists bool
+		status       int
+	}{
+		{"unknown parent", false, http.StatusNotFound},
+		{"parent the caller does not administer", true, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, fake := newFakeDB(t,
+				// The caller is admin of the organization but not a member of the parent
+				fakeQuery{match: "SELECT o.owner_id, l.role, r.permissions", columns: []string{"owner_id", "role", "permissions"},
+					respond: func(query string, args []driver.Value) [][]driver.Value {
+						if args[1] == testOrgID {
+							return [][]driver.Value{{testOwnerID, "admin", nil}}
+						}
+						return [][]driver.Value{{testOwnerID, nil, nil}}
+					}},
+				fakeQuery{match: "SELECT org_id, org_type FROM organizations", columns: []string{"org_id", "org_type"}, rows: [][]driver.Value{{nil, "organization"}}},
+				fakeQuery{match: "SELECT EXISTS(SELECT 1 FROM organizations WHERE id = $1 AND deleted_at IS NULL)",
+					columns: []string{"exists"}, rows: [][]driver.Value{{tt.parentExists}}},
+			)
+			s := newTestServer(t, db, http.NotFoundHandler())
+
+			r := withSession(httptest.NewRequest("PUT", "/organizations/"+testOrgID, strings.NewReader(`{"name": "Acme", "org_id": "`+parentID+`"}`)),
+				testUserID, map[string]string{"id": testOrgID})
+			w := httptest.NewRecorder()
+			s.updateOrganization(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.status, w.Body)
+			}
+			if fake.executed("UPDATE organizations") {
+				t.Error("organization re-parented")
+			}
+		})
+	}
+}
+
+func TestPatchTenantReparentQuota(t *testing.T) {
+	const parentID = "44444444-4444-4444-4444-444444444444"
+	tests := []struct {
+		name        string
+		quota       [][]driver.Value
+		featureMeta [][]driver.Value
+	}{
+		{"tenant quota", [][]driver.Value{{int64(2)}}, nil},
+		{"max_tenant_count flag", nil, [][]driver.Value{{[]byte(`{"limit": 2}`)}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, fake := newFakeDB(t, append(membershipQueries(testOwnerID, "admin", nil),
+				fakeQuery{match: "SELECT org_id, org_type FROM organizations", columns: []string{"org_id", "org_type"}, rows: [][]driver.Value{{nil, "tenant"}}},
+				fakeQuery{match: "SELECT EXISTS(SELECT 1 FROM organizations WHERE id = $1 AND deleted_at IS NULL)",
+					columns: []string{"exists"}, rows: [][]driver.Value{{true}}},
+				fakeQuery{match: "WITH RECURSIVE ancestors", columns: []string{"exists"}, rows: [][]driver.Value{{false}}},
+				fakeQuery{match: "FROM organization_quotas", columns: []string{"max_count"}, rows: tt.quota},
+				fakeQuery{match: "SELECT metadata FROM organization_features", columns: []string{"metadata"}, rows: tt.featureMeta},
+				fakeQuery{match: "FOR UPDATE"},
+				countRow("SELECT COUNT(*) FROM organizations", 2),
+			)...)
+			s := newTestServer(t, db, http.NotFoundHandler())
+
+			r := withSession(httptest.NewRequest("PATCH", "/organizations/"+testOrgID, strings.NewReader(`{"org_id": "`+parentID+`"}`)),
+				testUserID, map[string]string{"id": testOrgID})
+			w := httptest.NewRecorder()
+			s.patchOrganization(w, r)
+
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusForbidden, w.Body)
+			}
+			if fake.executed("UPDATE organizations") {
+				t.Error("tenant moved past the limit of its new parent")
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Migration files are named <version>_<description>.sql, e.g. 002_add_teams.sql
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_[\w-]+\.sql$`)
+
+// Arbitrary key for pg_advisory_lock so replicas starting together apply
+// migrations one at a time
+const migrationLockKey = 728301
+
+type migration struct {
+	version int
+	name    string
+	path    string
+}
+
+// runMigrations applies every migration in dir that is not yet recorded in
+// schema_migrations, in version order, each in its own transaction.
+//
+// Databases created from the old init.sql have the schema of 001 but no
+// schema_migrations table. For those, 001 is recorded as applied without
+// running it, so 001 must stay identical to that init.sql; later schema
+// changes go in new migrations written to tolerate objects that already
+// exist.
+func runMigrations(db *sql.DB, dir string) error {
+	migrations, err := readMigrations(dir)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	var tracked, legacy bool
+	err = conn.QueryRowContext(ctx, `
+		SELECT to_regclass('schema_migrations') IS NOT NULL, to_regclass('users') IS NOT NULL`,
+	).Scan(&tracked, &legacy)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations(
+			version integer PRIMARY KEY,
+			name varchar(255) NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	if !tracked && legacy && len(migrations) > 0 && migrations[0].version == 1 {
+		logWarning("Existing schema without schema_migrations, marking %s as applied", migrations[0].name)
+		_, err = conn.ExecContext(ctx,
+			"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+			migrations[0].version, migrations[0].name,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	applied := make(map[int]bool)
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		logDB("Applying migration %s", m.name)
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+		pending++
+	}
+
+	if pending == 0 {
+		logDB("Database schema up to date (%d migrations)", len(migrations))
+	} else {
+		logSuccess("Applied %d migration(s)", pending)
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	body, err := os.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, string(body)); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+		m.version, m.name,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// readMigrations lists the migration files in dir sorted by version. Other
+// files are ignored; two files with the same version are an error.
+func readMigrations(dir string) ([]migration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	seen := make(map[int]string)
+	migrations := []migration{}
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s", entry.Name())
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, entry.Name(), version)
+		}
+		seen[version] = entry.Name()
+		migrations = append(migrations, migration{
+			version: version,
+			name:    entry.Name(),
+			path:    filepath.Join(dir, entry.Name()),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
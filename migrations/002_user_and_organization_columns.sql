@@ -0,0 +1,7 @@
+-- Set by soft delete, cleared on restore
+ALTER TABLE organizations ADD COLUMN IF NOT EXISTS deleted_at timestamptz NULL;
+
+CREATE INDEX IF NOT EXISTS idx_organizations_parent_deleted ON organizations(org_id) WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS can_create_organizations boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_logout timestamptz NULL;
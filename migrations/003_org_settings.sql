@@ -0,0 +1,14 @@
+-- Per-organization overrides of system defaults
+CREATE TABLE IF NOT EXISTS org_settings(
+    organization_id uuid PRIMARY KEY REFERENCES organizations(id) ON DELETE CASCADE,
+    settings jsonb NOT NULL DEFAULT '{}',
+    api_rate_limit_rpm integer NULL,
+    updated_at timestamptz DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE org_settings ADD COLUMN IF NOT EXISTS api_rate_limit_rpm integer NULL;
+
+DROP TRIGGER IF EXISTS update_org_settings_updated_at ON org_settings;
+CREATE TRIGGER update_org_settings_updated_at 
+    BEFORE UPDATE ON org_settings 
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
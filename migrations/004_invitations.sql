@@ -0,0 +1,16 @@
+-- Invitations of users by email
+CREATE TABLE IF NOT EXISTS invitations(
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    organization_id uuid NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    email varchar(1024) NOT NULL,
+    role varchar(50) NOT NULL DEFAULT 'member',
+    token varchar(255) NOT NULL UNIQUE,
+    status varchar(20) NOT NULL DEFAULT 'pending',
+    expires_at timestamptz NOT NULL,
+    last_sent_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_by uuid NULL REFERENCES users(id) ON DELETE SET NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+    used_at timestamptz NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_invitations_org_status ON invitations(organization_id, status);
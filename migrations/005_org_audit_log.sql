@@ -0,0 +1,13 @@
+-- Changes made to an organization. Actor and target are not foreign keys so
+-- entries outlive deleted users.
+CREATE TABLE IF NOT EXISTS org_audit_log(
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    org_id uuid NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    actor_id uuid NULL,
+    action varchar(100) NOT NULL,
+    target_user_id uuid NULL,
+    metadata jsonb NOT NULL DEFAULT '{}',
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_org_audit_log_org_created ON org_audit_log(org_id, created_at DESC);
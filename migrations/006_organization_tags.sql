@@ -0,0 +1,9 @@
+-- Tags classifying organizations
+CREATE TABLE IF NOT EXISTS organization_tags(
+    org_id uuid NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    tag varchar(64) NOT NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (org_id, tag)
+);
+
+CREATE INDEX IF NOT EXISTS idx_organization_tags_tag ON organization_tags(tag);
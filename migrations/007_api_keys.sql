@@ -0,0 +1,16 @@
+-- API keys. Only a bcrypt hash of each key is stored; the prefix narrows
+-- down which hashes to compare against.
+CREATE TABLE IF NOT EXISTS api_keys(
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name varchar(255) NOT NULL,
+    key_prefix varchar(16) NOT NULL,
+    key_hash varchar(255) NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at timestamptz NULL,
+    expires_at timestamptz NULL,
+    revoked_at timestamptz NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_prefix ON api_keys(key_prefix) WHERE revoked_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_api_keys_user ON api_keys(user_id);
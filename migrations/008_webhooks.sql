@@ -0,0 +1,39 @@
+-- Kratos webhooks already processed, so retries are only handled once
+CREATE TABLE IF NOT EXISTS webhook_events(
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    event_type varchar(64) NOT NULL,
+    identity_id uuid NULL,
+    payload_hash char(64) NOT NULL UNIQUE,
+    processed_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Outbound organization event notifications
+CREATE TABLE IF NOT EXISTS webhooks(
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    org_id uuid NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    url varchar(2048) NOT NULL,
+    secret varchar(255) NOT NULL,
+    events text[] NOT NULL DEFAULT '{}',
+    is_active boolean NOT NULL DEFAULT true,
+    created_by uuid NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhooks_org ON webhooks(org_id) WHERE is_active;
+
+-- Each outbound delivery attempt
+CREATE TABLE IF NOT EXISTS webhook_deliveries(
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    webhook_id uuid NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_type varchar(64) NOT NULL,
+    payload jsonb NOT NULL,
+    status varchar(16) NOT NULL,
+    attempts integer NOT NULL DEFAULT 1,
+    next_retry_at timestamptz NULL,
+    response_code integer NULL,
+    last_error text NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_retry ON webhook_deliveries(next_retry_at) WHERE status = 'pending';
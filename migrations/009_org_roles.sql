@@ -0,0 +1,9 @@
+-- Roles an organization defines beyond the built-in owner/admin/member
+CREATE TABLE IF NOT EXISTS org_roles(
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    org_id uuid NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    name varchar(50) NOT NULL,
+    permissions jsonb NOT NULL DEFAULT '[]',
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (org_id, name)
+);
@@ -0,0 +1,24 @@
+-- Sub-groups of an organization's members
+CREATE TABLE IF NOT EXISTS teams(
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    org_id uuid NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    name varchar(255) NOT NULL,
+    description text NOT NULL DEFAULT '',
+    created_by uuid NULL REFERENCES users(id) ON DELETE SET NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (org_id, name)
+);
+
+-- Team membership references the organization link so leaving or being
+-- removed from the organization also removes it from teams
+CREATE TABLE IF NOT EXISTS team_members(
+    team_id uuid NOT NULL REFERENCES teams(id) ON DELETE CASCADE,
+    org_id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    role varchar(50) NOT NULL DEFAULT 'member',
+    joined_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (team_id, user_id),
+    FOREIGN KEY (user_id, org_id) REFERENCES user_organization_links(user_id, organization_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_team_members_user ON team_members(user_id);
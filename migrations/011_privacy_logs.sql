@@ -0,0 +1,20 @@
+-- Access to users' personal data. subject_id has no foreign key so entries
+-- survive the user's deletion.
+CREATE TABLE IF NOT EXISTS privacy_audit_log(
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    subject_id uuid NOT NULL,
+    actor_id uuid NULL,
+    action varchar(50) NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_privacy_audit_log_subject ON privacy_audit_log(subject_id, created_at DESC);
+
+-- Records that an erasure happened. It deliberately holds no personal data,
+-- not even the erased user's ID.
+CREATE TABLE IF NOT EXISTS data_erasure_log(
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    reason varchar(50) NOT NULL,
+    requested_by_admin boolean NOT NULL DEFAULT false,
+    erased_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,7 @@
+-- An organization can never be its own parent. Deeper cycles are rejected
+-- by the API, which walks the org_id chain before setting a parent.
+UPDATE organizations SET org_id = NULL WHERE org_id = id;
+
+ALTER TABLE organizations DROP CONSTRAINT IF EXISTS organizations_not_own_parent;
+ALTER TABLE organizations
+    ADD CONSTRAINT organizations_not_own_parent CHECK (id <> org_id);
@@ -0,0 +1,9 @@
+-- Per-user opt-outs for notifications. A missing row means enabled.
+CREATE TABLE IF NOT EXISTS notification_preferences(
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    event_type varchar(64) NOT NULL,
+    channel varchar(32) NOT NULL,
+    enabled boolean NOT NULL DEFAULT true,
+    updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, event_type, channel)
+);
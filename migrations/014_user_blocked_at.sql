@@ -0,0 +1,3 @@
+-- Set when a system admin blocks the user; sessions of blocked users are
+-- rejected even if Kratos still considers them valid
+ALTER TABLE users ADD COLUMN IF NOT EXISTS blocked_at timestamptz NULL;
@@ -0,0 +1,4 @@
+-- System admins granted through the API, in addition to SYSTEM_ADMIN_IDS
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_system_admin boolean NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS idx_users_system_admin ON users(id) WHERE is_system_admin;
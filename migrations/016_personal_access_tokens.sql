@@ -0,0 +1,17 @@
+-- Personal access tokens: user-issued bearer tokens limited by scopes.
+-- Like api_keys, only a bcrypt hash is stored and the prefix is kept in
+-- clear to find candidate rows.
+CREATE TABLE IF NOT EXISTS personal_access_tokens(
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name varchar(255) NOT NULL,
+    token_hash varchar(255) NOT NULL,
+    prefix varchar(32) NOT NULL,
+    scopes text[] NOT NULL DEFAULT '{read}',
+    expires_at timestamptz NULL,
+    last_used_at timestamptz NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_prefix ON personal_access_tokens(prefix);
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user ON personal_access_tokens(user_id);
@@ -0,0 +1,10 @@
+-- Per-organization feature flags. A missing row means the flag's default
+-- (see orgFeatureDefaults).
+CREATE TABLE IF NOT EXISTS organization_features(
+    org_id uuid NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    feature_name varchar(64) NOT NULL,
+    enabled boolean NOT NULL DEFAULT false,
+    metadata jsonb NOT NULL DEFAULT '{}',
+    updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (org_id, feature_name)
+);
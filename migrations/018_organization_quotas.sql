@@ -0,0 +1,9 @@
+-- Per-organization limits on resources. A missing row means unlimited.
+-- Usage is counted from the resource tables when checked, not stored here.
+CREATE TABLE IF NOT EXISTS organization_quotas(
+    org_id uuid NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    resource_type varchar(32) NOT NULL,
+    max_count integer NOT NULL CHECK (max_count >= 0),
+    updated_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (org_id, resource_type)
+);
@@ -0,0 +1,17 @@
+-- Authentication events (logins, logouts, validations and failures), kept
+-- apart from the per-organization audit log. user_id is not a foreign key
+-- so entries outlive deleted users.
+CREATE TABLE IF NOT EXISTS audit_auth_log(
+    id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id uuid NULL,
+    event_type varchar(32) NOT NULL,
+    ip_address varchar(64) NOT NULL DEFAULT '',
+    user_agent text NOT NULL DEFAULT '',
+    session_id varchar(255) NULL,
+    success boolean NOT NULL,
+    error_message text NULL,
+    created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_auth_log_user ON audit_auth_log(user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_audit_auth_log_created ON audit_auth_log(created_at DESC);
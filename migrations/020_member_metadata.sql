@@ -0,0 +1,3 @@
+-- Free-form data an organization attaches to a membership, e.g. department
+-- or employee ID
+ALTER TABLE user_organization_links ADD COLUMN IF NOT EXISTS metadata jsonb NOT NULL DEFAULT '{}';
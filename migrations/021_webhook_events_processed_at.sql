@@ -0,0 +1,2 @@
+-- The cleanup worker prunes processed Kratos webhook events by age
+CREATE INDEX IF NOT EXISTS idx_webhook_events_processed_at ON webhook_events(processed_at);
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Events users can be notified about
+const (
+	notificationMemberInvited = "member_invited"
+	notificationMemberJoined  = "member_joined"
+	notificationRoleChanged   = "role_changed"
+	notificationOrgCreated    = "org_created"
+	notificationSecurityAlert = "security_alert"
+)
+
+var notificationEvents = []string{
+	notificationMemberInvited,
+	notificationMemberJoined,
+	notificationRoleChanged,
+	notificationOrgCreated,
+	notificationSecurityAlert,
+}
+
+// Channels notifications can be delivered on
+const notificationChannelEmail = "email"
+
+var notificationChannels = []string{notificationChannelEmail}
+
+// NotificationPreference turns one event on one channel on or off for a
+// user. Every combination is enabled unless the user has turned it off.
+type NotificationPreference struct {
+	EventType string     `json:"event_type" validate:"required,oneof=member_invited member_joined role_changed org_created security_alert"`
+	Channel   string     `json:"channel" validate:"required,oneof=email"`
+	Enabled   bool       `json:"enabled"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// getNotificationPreferences returns every event and channel combination
+// for userID, with the user's stored choices applied over the defaults
+func (s *Server) getNotificationPreferences(userID string) ([]NotificationPreference, error) {
+	rows, err := s.db.Query(`
+		SELECT event_type, channel, enabled, updated_at
+		FROM notification_preferences
+		WHERE user_id = $1`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]NotificationPreference)
+	for rows.Next() {
+		var pref NotificationPreference
+		var updatedAt time.Time
+		if err := rows.Scan(&pref.EventType, &pref.Channel, &pref.Enabled, &updatedAt); err != nil {
+			return nil, err
+		}
+		pref.UpdatedAt = &updatedAt
+		stored[pref.EventType+"/"+pref.Channel] = pref
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	prefs := make([]NotificationPreference, 0, len(notificationEvents)*len(notificationChannels))
+	for _, event := range notificationEvents {
+		for _, channel := range notificationChannels {
+			pref, ok := stored[event+"/"+channel]
+			if !ok {
+				pref = NotificationPreference{EventType: event, Channel: channel, Enabled: true}
+			}
+			prefs = append(prefs, pref)
+		}
+	}
+	return prefs, nil
+}
+
+// notificationEnabled reports whether userID wants event on channel. Errors
+// are logged and count as enabled so a database hiccup doesn't swallow
+// notifications.
+func (s *Server) notificationEnabled(userID, event, channel string) bool {
+	var enabled bool
+	err := s.db.QueryRow(`
+		SELECT enabled FROM notification_preferences
+		WHERE user_id = $1 AND event_type = $2 AND channel = $3`,
+		userID, event, channel,
+	).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return true
+	}
+	if err != nil {
+		logError("Failed to read notification preference %s/%s of user %s: %v", event, channel, userID, err)
+		return true
+	}
+	return enabled
+}
+
+// getNotificationPreferencesHandler lists a user's notification preferences.
+// Users can read their own; system admins can read anyone's.
+func (s *Server) getNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSessionFromRequest(r)
+	if err != nil {
+		logAuth("Unauthorized get notification preferences: %v", err)
+		WriteError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	userID := mux.Vars(r)["id"]
+	if session.Identity.Id != userID && !s.isSystemAdminSession(session) {
+		logAuth("User %s not authorized to read notification preferences of %s", session.Identity.Id, userID)
+		WriteError(w, http.StatusForbidden, ErrCodeForbidden, "Forbidden")
+		return
+	}
+
+	prefs, err := s.getNotificationPreferences(userID)
+	if err != nil {
+		logError("Failed to fetch notification preferences of user %s: %v", userID, err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch notification preferences")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"preferences": prefs})
+}
+
+// updateNotificationPreferences stores the given preferences. Combinations
+// left out of the request keep their current value. Only the user can
+// change their own preferences.
+func (s *Server) updateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	logInfo("Processing update notification preferences request")
+
+	session, err := s.getSessionFromRequest(r)
+	if err != nil {
+		logAuth("Unauthorized update notification preferences: %v", err)
+		WriteError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	userID := mux.Vars(r)["id"]
+	if session.Identity.Id != userID {
+		logAuth("User %s tried to change notification preferences of %s", session.Identity.Id, userID)
+		WriteError(w, http.StatusForbidden, ErrCodeForbidden, "Forbidden - You can only update your own notification preferences")
+		return
+	}
+
+	var req []NotificationPreference
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logWarning("Invalid request body for notification preferences: %v", err)
+		WriteError(w, http.StatusBadRequest, ErrCodeBadRequest, "Invalid request body")
+		return
+	}
+	if len(req) == 0 {
+		WriteError(w, http.StatusBadRequest, ErrCodeBadRequest, "No preferences to update")
+		return
+	}
+	for i := range req {
+		if errs := validateStruct(&req[i]); len(errs) > 0 {
+			WriteError(w, http.StatusBadRequest, ErrCodeValidationFailed, fmt.Sprintf("[%d].%s", i, errs[0].Error()))
+			return
+		}
+	}
+
+	// Profiles are normally saved on login; make sure the row the
+	// preferences reference exists
+	s.saveUserProfile(session.Identity)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		logError("Failed to start transaction: %v", err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update notification preferences")
+		return
+	}
+	defer tx.Rollback()
+
+	for _, pref := range req {
+		_, err = tx.Exec(`
+			INSERT INTO notification_preferences (user_id, event_type, channel, enabled)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, event_type, channel)
+			DO UPDATE SET enabled = $4, updated_at = CURRENT_TIMESTAMP`,
+			userID, pref.EventType, pref.Channel, pref.Enabled,
+		)
+		if err != nil {
+			logError("Failed to store notification preference for user %s: %v", userID, err)
+			WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update notification preferences")
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		logError("Failed to commit notification preferences: %v", err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update notification preferences")
+		return
+	}
+
+	prefs, err := s.getNotificationPreferences(userID)
+	if err != nil {
+		logError("Failed to fetch notification preferences of user %s: %v", userID, err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch notification preferences")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"preferences": prefs})
+
+	logSuccess("Notification preferences updated for user %s", userID)
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The API description is served outside the versioned prefix and needs no
+// session
+const (
+	openAPIPath = "/api/openapi.json"
+	apiDocsPath = "/api/docs"
+)
+
+// routeDoc describes one operation. Request and Response are zero values of
+// the types read and written by the handler; their schemas are derived from
+// the json and validate struct tags.
+type routeDoc struct {
+	Summary  string
+	Tag      string
+	Request  interface{}
+	Response interface{}
+	Status   int  // success status, 200 if zero
+	Public   bool // no session required
+}
+
+// routeDocs is keyed by "METHOD path", with API paths relative to
+// /api/{version}. Routes missing here still appear in the spec, just
+// without schemas.
+var routeDocs = map[string]routeDoc{
+	"GET /api":            {Summary: "List supported API versions", Tag: "system", Public: true},
+	"GET " + openAPIPath:  {Summary: "This OpenAPI description", Tag: "system", Public: true},
+	"GET " + apiDocsPath:  {Summary: "Swagger UI for this API", Tag: "system", Public: true},
+	"GET /health":         {Summary: "Health check including the database", Tag: "system", Public: true},
+	"GET /health/live":    {Summary: "Liveness probe", Tag: "system", Public: true},
+	"GET /health/ready":   {Summary: "Readiness probe", Tag: "system", Public: true},
+	"GET /metrics":        {Summary: "Prometheus metrics", Tag: "system", Public: true},
+	"GET /auth/session":   {Summary: "Current Kratos session", Tag: "auth"},
+	"POST /auth/logout":   {Summary: "Log out of the current session", Tag: "auth"},
+	"GET /auth/providers": {Summary: "Enabled login providers", Tag: "auth", Response: []AuthProvider{}, Public: true},
+	"GET /debug/auth":     {Summary: "Describe how the request authenticated", Tag: "auth"},
+	"GET /whoami":         {Summary: "Current user", Tag: "users", Response: User{}},
+	"GET /users": {Summary: "List users", Tag: "users", Response: struct {
+		Users         []User `json:"users"`
+		Total         int    `json:"total"`
+		NextPageToken string `json:"next_page_token"`
+		NextCursor    string `json:"next_cursor,omitempty"`
+	}{}},
+	"GET /users/export":           {Summary: "Export users as CSV", Tag: "users"},
+	"GET /users/{id}":             {Summary: "Get a user", Tag: "users", Response: User{}},
+	"DELETE /users/{id}":          {Summary: "Delete a user, or preview with ?dry_run=true", Tag: "users", Response: DeletionPreview{}},
+	"GET /users/{id}/data-export": {Summary: "Export all personal data of a user", Tag: "privacy"},
+	"DELETE /users/{id}/data":     {Summary: "Erase all personal data of a user", Tag: "privacy", Request: EraseUserDataRequest{}, Status: http.StatusNoContent},
+	"GET /users/{id}/activity": {Summary: "Activity feed of a user", Tag: "users", Response: struct {
+		Activities []ActivityEntry `json:"activities"`
+		Total      int             `json:"total"`
+	}{}},
+	"GET /users/{id}/notifications": {Summary: "Notification preferences of a user", Tag: "users", Response: struct {
+		Preferences []NotificationPreference `json:"preferences"`
+	}{}},
+	"PUT /users/{id}/notifications": {Summary: "Update own notification preferences", Tag: "users", Request: []NotificationPreference{}, Response: struct {
+		Preferences []NotificationPreference `json:"preferences"`
+	}{}},
+	"PATCH /users/{id}/profile":                {Summary: "Update profile fields", Tag: "users", Request: UpdateProfileRequest{}, Response: User{}},
+	"PUT /users/{id}/traits":                   {Summary: "Replace Kratos traits (system admin)", Tag: "users", Request: UpdateTraitsRequest{}},
+	"PUT /users/{id}/permissions":              {Summary: "Update user permissions", Tag: "users", Request: UpdatePermissionsRequest{}},
+	"GET /users/{id}/sessions":                 {Summary: "List active sessions", Tag: "users", Response: []UserSessionInfo{}},
+	"DELETE /users/{id}/sessions/{session_id}": {Summary: "Revoke a session", Tag: "users", Status: http.StatusNoContent},
+
+	"POST /users/{id}/tokens":             {Summary: "Create a personal access token", Tag: "users", Request: CreatePATRequest{}, Status: http.StatusCreated},
+	"GET /users/{id}/tokens":              {Summary: "List personal access tokens", Tag: "users", Response: []PersonalAccessToken{}},
+	"DELETE /users/{id}/tokens/{tokenId}": {Summary: "Delete a personal access token", Tag: "users", Status: http.StatusNoContent},
+
+	"POST /organizations": {Summary: "Create an organization", Tag: "organizations", Request: CreateOrgRequest{}, Response: Organization{}, Status: http.StatusCreated},
+	"GET /organizations": {Summary: "List the caller's organizations", Tag: "organizations", Response: struct {
+		Organizations []Organization `json:"organizations"`
+		Total         int            `json:"total"`
+		Page          int            `json:"page,omitempty"`
+		Limit         int            `json:"limit"`
+		NextCursor    string         `json:"next_cursor,omitempty"`
+	}{}},
+	"POST /organizations/join/{token}": {Summary: "Accept an invitation", Tag: "invitations"},
+	"GET /organizations/hierarchy":     {Summary: "Organization tree of the caller", Tag: "organizations", Response: []OrgNode{}},
+	"GET /organizations/{id}":          {Summary: "Get an organization", Tag: "organizations", Response: Organization{}},
+	"PUT /organizations/{id}":          {Summary: "Replace an organization", Tag: "organizations", Request: UpdateOrgRequest{}, Response: Organization{}},
+	"PATCH /organizations/{id}":        {Summary: "Update an organization", Tag: "organizations", Request: UpdateOrgRequest{}, Response: Organization{}},
+	"DELETE /organizations/{id}":       {Summary: "Soft-delete an organization", Tag: "organizations"},
+	"POST /organizations/{id}/restore": {Summary: "Restore a deleted organization", Tag: "organizations", Response: Organization{}},
+	"POST /organizations/{id}/members": {Summary: "Add a member", Tag: "members", Request: InviteUserRequest{}},
+	"GET /organizations/{id}/members": {Summary: "List members", Tag: "members", Response: struct {
+		Members  []Member `json:"members"`
+		Total    int      `json:"total"`
+		Page     int      `json:"page"`
+		PageSize int      `json:"page_size"`
+	}{}},
+	"GET /organizations/{id}/members/export":                {Summary: "Export members as CSV", Tag: "members"},
+	"POST /organizations/{id}/members/reinvite-all-pending": {Summary: "Resend all pending invitations", Tag: "invitations"},
+	"POST /organizations/{id}/members/bulk":                 {Summary: "Add members in bulk", Tag: "members", Request: BulkAddMembersRequest{}},
+	"DELETE /organizations/{id}/members/bulk":               {Summary: "Remove members in bulk", Tag: "members", Request: BulkRemoveMembersRequest{}},
+	"POST /organizations/{id}/members/import": {Summary: "Import members from CSV", Tag: "members", Response: struct {
+		Imported int              `json:"imported"`
+		Skipped  int              `json:"skipped"`
+		Errors   []ImportRowError `json:"errors"`
+		DryRun   bool             `json:"dry_run"`
+	}{}},
+	"DELETE /organizations/{id}/members/{userId}":         {Summary: "Remove a member", Tag: "members"},
+	"PUT /organizations/{id}/members/{userId}/role":       {Summary: "Change a member's role", Tag: "members", Request: UpdateMemberRoleRequest{}, Response: Member{}},
+	"PATCH /organizations/{id}/members/{userId}/metadata": {Summary: "Replace a member's custom metadata", Tag: "members", Request: UpdateMemberMetadataRequest{}, Response: Member{}},
+	"POST /organizations/{id}/leave":                      {Summary: "Leave an organization", Tag: "members"},
+	"POST /organizations/{id}/transfer":                   {Summary: "Transfer ownership", Tag: "organizations", Request: TransferOwnershipRequest{}},
+	"POST /organizations/{id}/sync-members-from-kratos":   {Summary: "Sync members from Kratos traits", Tag: "members"},
+	"POST /organizations/{id}/invitations":                {Summary: "Invite a user", Tag: "invitations", Request: InviteUserRequest{}, Response: Invitation{}, Status: http.StatusCreated},
+	"GET /organizations/{id}/invitations":                 {Summary: "List invitations", Tag: "invitations", Response: []Invitation{}},
+	"DELETE /organizations/{id}/invitations/{token}":      {Summary: "Revoke an invitation", Tag: "invitations"},
+	"GET /organizations/{id}/access-check":                {Summary: "Actions the caller may perform", Tag: "organizations"},
+	"GET /organizations/{id}/stats":                       {Summary: "Organization statistics", Tag: "organizations", Response: OrgStats{}},
+	"GET /organizations/{id}/events":                      {Summary: "Stream membership changes as server-sent events", Tag: "organizations"},
+	"GET /organizations/{id}/tags":                        {Summary: "List tags", Tag: "organizations", Response: []string{}},
+	"POST /organizations/{id}/tags":                       {Summary: "Add a tag", Tag: "organizations", Request: TagRequest{}},
+	"DELETE /organizations/{id}/tags/{tag}":               {Summary: "Remove a tag", Tag: "organizations"},
+	"GET /organizations/{id}/audit-log": {Summary: "Organization audit log", Tag: "organizations", Response: struct {
+		Entries  []AuditEntry `json:"entries"`
+		Total    int          `json:"total"`
+		Page     int          `json:"page"`
+		PageSize int          `json:"page_size"`
+	}{}},
+	"GET /organizations/{id}/roles": {Summary: "List built-in and custom roles", Tag: "roles", Response: struct {
+		BuiltinRoles []string  `json:"builtin_roles"`
+		Roles        []OrgRole `json:"roles"`
+	}{}},
+	"POST /organizations/{id}/roles":            {Summary: "Create a custom role", Tag: "roles", Request: OrgRoleRequest{}, Response: OrgRole{}, Status: http.StatusCreated},
+	"PUT /organizations/{id}/roles/{roleId}":    {Summary: "Update a custom role", Tag: "roles", Request: OrgRoleRequest{}, Response: OrgRole{}},
+	"DELETE /organizations/{id}/roles/{roleId}": {Summary: "Delete a custom role", Tag: "roles", Status: http.StatusNoContent},
+	"GET /organizations/{id}/teams": {Summary: "List teams", Tag: "teams", Response: struct {
+		Teams []Team `json:"teams"`
+	}{}},
+	"POST /organizations/{id}/teams":                             {Summary: "Create a team", Tag: "teams", Request: TeamRequest{}, Response: Team{}, Status: http.StatusCreated},
+	"GET /organizations/{id}/teams/{teamId}":                     {Summary: "Get a team with its members", Tag: "teams", Response: Team{}},
+	"PUT /organizations/{id}/teams/{teamId}":                     {Summary: "Update a team", Tag: "teams", Request: TeamRequest{}, Response: Team{}},
+	"DELETE /organizations/{id}/teams/{teamId}":                  {Summary: "Delete a team", Tag: "teams", Status: http.StatusNoContent},
+	"GET /organizations/{id}/teams/{teamId}/members":             {Summary: "List team members", Tag: "teams", Response: []Member{}},
+	"POST /organizations/{id}/teams/{teamId}/members":            {Summary: "Add or update a team member", Tag: "teams", Request: AddTeamMemberRequest{}},
+	"DELETE /organizations/{id}/teams/{teamId}/members/{userId}": {Summary: "Remove a team member", Tag: "teams", Status: http.StatusNoContent},
+	"GET /organizations/{id}/settings":                           {Summary: "Organization settings", Tag: "settings", Response: OrgSettings{}},
+	"PUT /organizations/{id}/settings":                           {Summary: "Update organization settings", Tag: "settings", Request: OrgSettings{}, Response: OrgSettings{}},
+	"GET /organizations/{id}/settings/effective":                 {Summary: "Settings with their sources", Tag: "settings"},
+	"PUT /organizations/{id}/settings/rate-limit":                {Summary: "Set the organization's API rate limit", Tag: "settings", Request: UpdateRateLimitRequest{}},
+
+	"GET /organizations/{id}/features": {Summary: "Feature flags of an organization (owner or system admin)", Tag: "settings", Response: struct {
+		Features []OrgFeature `json:"features"`
+	}{}},
+	"PUT /organizations/{id}/features": {Summary: "Set feature flags (system admin)", Tag: "settings", Request: []OrgFeature{}, Response: struct {
+		Features []OrgFeature `json:"features"`
+	}{}},
+	"GET /organizations/{id}/quota": {Summary: "Quotas and usage of an organization", Tag: "settings", Response: struct {
+		Quotas []OrgQuota `json:"quotas"`
+	}{}},
+	"PUT /organizations/{id}/quota": {Summary: "Set or clear quotas (system admin)", Tag: "settings", Request: []OrgQuota{}, Response: struct {
+		Quotas []OrgQuota `json:"quotas"`
+	}{}},
+
+	"POST /api-keys":             {Summary: "Create an API key", Tag: "api-keys", Request: CreateAPIKeyRequest{}, Status: http.StatusCreated},
+	"GET /api-keys":              {Summary: "List the caller's API keys", Tag: "api-keys", Response: []APIKey{}},
+	"POST /api-keys/validate":    {Summary: "Validate an API key", Tag: "api-keys", Request: ValidateAPIKeyRequest{}, Public: true},
+	"DELETE /api-keys/{id}":      {Summary: "Revoke an API key", Tag: "api-keys"},
+	"PUT /api-keys/{id}/extend":  {Summary: "Extend an API key's expiry", Tag: "api-keys", Request: ExtendAPIKeyRequest{}, Response: APIKey{}},
+	"POST /api-keys/{id}/rotate": {Summary: "Rotate an API key", Tag: "api-keys"},
+	"POST /webhooks":             {Summary: "Subscribe an organization to events", Tag: "webhooks", Request: CreateWebhookRequest{}, Response: Webhook{}, Status: http.StatusCreated},
+	"GET /webhooks":              {Summary: "List webhooks", Tag: "webhooks", Response: []Webhook{}},
+	"DELETE /webhooks/{id}":      {Summary: "Delete a webhook", Tag: "webhooks"},
+	"POST /webhooks/{id}/test":   {Summary: "Send a test event", Tag: "webhooks"},
+	"GET /admin/organizations":   {Summary: "List all organizations (system admin)", Tag: "admin"},
+
+	"POST /admin/users/{id}/block":        {Summary: "Block a user from logging in (system admin)", Tag: "admin"},
+	"POST /admin/users/{id}/unblock":      {Summary: "Unblock a user (system admin)", Tag: "admin"},
+	"POST /admin/users/{id}/grant-admin":  {Summary: "Make a user a system admin (system admin)", Tag: "admin"},
+	"POST /admin/users/{id}/revoke-admin": {Summary: "Revoke system admin from a user (system admin)", Tag: "admin"},
+	"GET /admin/audit/auth": {Summary: "Authentication audit log (system admin)", Tag: "admin", Response: struct {
+		Entries  []AuthAuditEntry `json:"entries"`
+		Total    int              `json:"total"`
+		Page     int              `json:"page"`
+		PageSize int              `json:"page_size"`
+	}{}},
+	"GET /admin/db/stats": {Summary: "Database connection pool statistics (system admin)", Tag: "admin", Response: DBStats{}},
+
+	"POST /hooks/after-registration": {Summary: "Kratos after-registration hook", Tag: "hooks", Request: WebhookPayload{}, Public: true},
+	"POST /hooks/after-login":        {Summary: "Kratos after-login hook", Tag: "hooks", Request: WebhookPayload{}, Public: true},
+	"POST /hooks/after-logout":       {Summary: "Kratos after-logout hook", Tag: "hooks", Request: WebhookPayload{}, Public: true},
+
+	"GET /scim/v2/Users":         {Summary: "SCIM: list users", Tag: "scim", Response: SCIMListResponse{}, Public: true},
+	"POST /scim/v2/Users":        {Summary: "SCIM: create a user", Tag: "scim", Request: SCIMUser{}, Response: SCIMUser{}, Status: http.StatusCreated, Public: true},
+	"GET /scim/v2/Groups":        {Summary: "SCIM: list groups", Tag: "scim", Response: SCIMListResponse{}, Public: true},
+	"POST /scim/v2/Groups":       {Summary: "SCIM: create a group", Tag: "scim", Request: SCIMGroup{}, Response: SCIMGroup{}, Status: http.StatusCreated, Public: true},
+	"GET /scim/v2/Groups/{id}":   {Summary: "SCIM: get a group", Tag: "scim", Response: SCIMGroup{}, Public: true},
+	"PATCH /scim/v2/Groups/{id}": {Summary: "SCIM: patch a group", Tag: "scim", Request: SCIMPatchRequest{}, Response: SCIMGroup{}, Public: true},
+}
+
+// serveOpenAPI serves the description of every route on router. It is
+// built on the first request since the router is complete by then.
+func (s *Server) serveOpenAPI(router *mux.Router) http.HandlerFunc {
+	var once sync.Once
+	var spec []byte
+	var buildErr error
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			spec, buildErr = json.Marshal(buildOpenAPISpec(router, s.config().Version))
+		})
+		if buildErr != nil {
+			logError("Failed to build OpenAPI spec: %v", buildErr)
+			WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to build API description")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	}
+}
+
+// serveAPIDocs serves Swagger UI pointed at openAPIPath
+func serveAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(apiDocsHTML))
+}
+
+const apiDocsHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>User Management API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "` + openAPIPath + `", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+var pathParamPattern = regexp.MustCompile(`\{([^}:]+)(?::[^}]*)?\}`)
+
+// buildOpenAPISpec walks the router and documents every route once. The
+// deprecated unversioned /api aliases are left out.
+func buildOpenAPISpec(router *mux.Router, version string) map[string]interface{} {
+	apiPrefix := "/api/" + version
+	schemas := newSchemaRegistry()
+	paths := make(map[string]map[string]interface{})
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Subrouter prefixes carry no methods
+			return nil
+		}
+
+		docPath := template
+		switch {
+		case strings.HasPrefix(template, apiPrefix+"/"):
+			docPath = strings.TrimPrefix(template, apiPrefix)
+		case strings.HasPrefix(template, "/api/") && template != openAPIPath && template != apiDocsPath:
+			return nil
+		}
+
+		specPath := pathParamPattern.ReplaceAllString(template, "{$1}")
+		if paths[specPath] == nil {
+			paths[specPath] = make(map[string]interface{})
+		}
+		for _, method := range methods {
+			doc := routeDocs[method+" "+docPath]
+			paths[specPath][strings.ToLower(method)] = buildOperation(method, specPath, doc, schemas)
+		}
+		return nil
+	})
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "User Management API",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.schemas,
+			"securitySchemes": map[string]interface{}{
+				"sessionCookie": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "ory_kratos_session"},
+				"bearerToken":   map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"apiKey":        map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+	}
+}
+
+func buildOperation(method, path string, doc routeDoc, schemas *schemaRegistry) map[string]interface{} {
+	op := map[string]interface{}{}
+	if doc.Summary != "" {
+		op["summary"] = doc.Summary
+	}
+	if doc.Tag != "" {
+		op["tags"] = []string{doc.Tag}
+	}
+
+	params := []interface{}{}
+	for _, match := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		params = append(params, map[string]interface{}{
+			"name":     match[1],
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+
+	if doc.Request != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schemas.schemaFor(reflect.TypeOf(doc.Request))},
+			},
+		}
+	}
+
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if doc.Response != nil {
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemas.schemaFor(reflect.TypeOf(doc.Response))},
+		}
+	}
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemas.schemaFor(reflect.TypeOf(APIError{}))},
+		},
+	}
+	op["responses"] = map[string]interface{}{
+		strconv.Itoa(status): success,
+		"default":            errorResponse,
+	}
+
+	if doc.Public {
+		op["security"] = []interface{}{}
+	} else {
+		op["security"] = []interface{}{
+			map[string]interface{}{"sessionCookie": []string{}},
+			map[string]interface{}{"bearerToken": []string{}},
+			map[string]interface{}{"apiKey": []string{}},
+		}
+	}
+	return op
+}
+
+// schemaRegistry turns Go types into JSON schemas. Named structs are stored
+// once under components/schemas and referenced, which also keeps recursive
+// types such as OrgNode finite.
+type schemaRegistry struct {
+	schemas map[string]interface{}
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{schemas: make(map[string]interface{})}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (sr *schemaRegistry) schemaFor(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		schema := sr.schemaFor(t.Elem())
+		if _, isRef := schema["$ref"]; isRef {
+			return schema
+		}
+		schema["nullable"] = true
+		return schema
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": sr.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": sr.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sr.structSchema(t)
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := sr.schemas[t.Name()]; !ok {
+			sr.schemas[t.Name()] = map[string]interface{}{} // placeholder while recursing
+			sr.schemas[t.Name()] = sr.structSchema(t)
+		}
+		return ref
+	}
+	// interface{} and anything else accepts any JSON value
+	return map[string]interface{}{}
+}
+
+func (sr *schemaRegistry) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := sr.schemaFor(field.Type)
+		for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+			ruleName, arg, _ := strings.Cut(rule, "=")
+			switch ruleName {
+			case "required":
+				required = append(required, name)
+			case "email":
+				schema["format"] = "email"
+			case "uuid":
+				schema["format"] = "uuid"
+			case "url":
+				schema["format"] = "uri"
+			case "max":
+				if limit, err := strconv.Atoi(arg); err == nil {
+					schema["maxLength"] = limit
+				}
+			case "oneof":
+				schema["enum"] = strings.Fields(arg)
+			}
+		}
+		properties[name] = schema
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	client "github.com/ory/kratos-client-go"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Personal access tokens look like userms_pat_<40 base58 characters>. Like
+// API keys, only a bcrypt hash is stored and the first patPrefixLength
+// characters (including userms_pat_) are kept in clear to find candidates.
+const (
+	patTokenPrefix  = "userms_pat_"
+	patRandomLength = 40
+	patPrefixLength = len(patTokenPrefix) + 8
+	// Bitcoin alphabet: no 0, O, I or l
+	base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+)
+
+// PAT scopes. read allows only safe methods, write allows everything
+// except acting as a system admin, admin allows everything the user could do.
+const (
+	patScopeRead  = "read"
+	patScopeWrite = "write"
+	patScopeAdmin = "admin"
+)
+
+// PAT-authenticated requests get a synthetic session whose ID carries this
+// prefix, like apiKeySessionPrefix
+const patSessionPrefix = "pat:"
+
+type PersonalAccessToken struct {
+	ID         string     `json:"id"`
+	UserID     string     `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type CreatePATRequest struct {
+	Name          string   `json:"name" validate:"required,trim,max=255"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+// redactToken shortens a bearer token for logging. PATs keep only the
+// prefix stored in clear, so nothing of their secret part is logged.
+func redactToken(token string) string {
+	if strings.HasPrefix(token, patTokenPrefix) {
+		return token[:min(len(token), patPrefixLength)] + "..."
+	}
+	return token[:min(len(token), 20)] + "..."
+}
+
+func isPATSession(session *client.Session) bool {
+	return strings.HasPrefix(session.Id, patSessionPrefix)
+}
+
+// generatePAT returns a new token and its bcrypt hash
+func generatePAT() (string, string, error) {
+	var b strings.Builder
+	b.WriteString(patTokenPrefix)
+	max := big.NewInt(int64(len(base58Alphabet)))
+	for i := 0; i < patRandomLength; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", "", err
+		}
+		b.WriteByte(base58Alphabet[n.Int64()])
+	}
+	plaintext := b.String()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", err
+	}
+	return plaintext, string(hash), nil
+}
+
+// authenticatePAT returns the unexpired token matching plaintext, or nil if
+// there is none. Successful lookups update last_used_at.
+func (s *Server) authenticatePAT(plaintext string) (*PersonalAccessToken, error) {
+	if len(plaintext) != len(patTokenPrefix)+patRandomLength {
+		return nil, nil
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, user_id, name, prefix, token_hash, scopes, expires_at, created_at
+		FROM personal_access_tokens
+		WHERE prefix = $1 AND (expires_at IS NULL OR expires_at > NOW())`,
+		plaintext[:patPrefixLength],
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pat PersonalAccessToken
+		var hash string
+		var expiresAt sql.NullTime
+		err := rows.Scan(&pat.ID, &pat.UserID, &pat.Name, &pat.Prefix, &hash,
+			pq.Array(&pat.Scopes), &expiresAt, &pat.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintext)) != nil {
+			continue
+		}
+
+		if expiresAt.Valid {
+			pat.ExpiresAt = &expiresAt.Time
+		}
+		now := time.Now()
+		pat.LastUsedAt = &now
+		if _, err := s.db.Exec("UPDATE personal_access_tokens SET last_used_at = $1 WHERE id = $2", now, pat.ID); err != nil {
+			logWarning("Failed to update last_used_at for PAT %s: %v", pat.ID, err)
+		}
+		return &pat, nil
+	}
+
+	return nil, rows.Err()
+}
+
+// getSessionFromPAT builds a session for the token's owner
+func (s *Server) getSessionFromPAT(token string) (*client.Session, error) {
+	pat, err := s.authenticatePAT(token)
+	if err != nil {
+		logAuth("❌ PAT lookup failed: %v", err)
+		return nil, fmt.Errorf("invalid personal access token")
+	}
+	if pat == nil {
+		logAuth("❌ PAT not recognised")
+		return nil, fmt.Errorf("invalid personal access token")
+	}
+
+	identity, resp, err := s.kratosAdmin.IdentityApi.GetIdentity(context.Background(), pat.UserID).Execute()
+	defer closeKratosResponse(resp)
+	if err != nil {
+		logAuth("❌ Identity %s for PAT %s not found: %v (status: %d)", pat.UserID, pat.ID, err, kratosStatus(resp))
+		return nil, fmt.Errorf("invalid personal access token")
+	}
+
+	active := true
+	session := client.NewSession(patSessionPrefix+pat.ID, *identity)
+	session.Active = &active
+	session.ExpiresAt = pat.ExpiresAt
+
+	logAuth("✅ PAT %s validated for user: %s", pat.ID, pat.UserID)
+	authSessionsValidated.WithLabelValues("pat").Inc()
+	return session, nil
+}
+
+// patScopeMiddleware limits PAT-authenticated requests to what the token's
+// scopes allow. Other requests pass through unchanged.
+func (s *Server) patScopeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := sessionFromContext(r.Context())
+		if !ok || !isPATSession(session) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scopes, err := s.patScopes(session)
+		if err != nil {
+			logError("Failed to load scopes of PAT %s: %v", session.Id, err)
+			WriteError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+			return
+		}
+
+		if required := requiredPATScope(r); !patScopeAllows(scopes, required) {
+			logAuth("PAT %s lacks %s scope for %s %s", session.Id, required, r.Method, r.URL.Path)
+			WriteError(w, http.StatusForbidden, ErrCodeForbidden,
+				fmt.Sprintf("Forbidden - token requires the %s scope", required))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requiredPATScope is read for safe methods and write for everything else.
+// The admin scope is checked by isSystemAdminSession wherever a handler
+// relies on system admin rights.
+func requiredPATScope(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return patScopeRead
+	}
+	return patScopeWrite
+}
+
+// patScopeAllows reports whether scopes cover required. Each scope implies
+// the ones below it: admin > write > read.
+func patScopeAllows(scopes []string, required string) bool {
+	rank := map[string]int{patScopeRead: 1, patScopeWrite: 2, patScopeAdmin: 3}
+	for _, scope := range scopes {
+		if rank[scope] >= rank[required] {
+			return true
+		}
+	}
+	return false
+}
+
+// patScopes loads the scopes of the token behind a PAT session
+func (s *Server) patScopes(session *client.Session) ([]string, error) {
+	var scopes []string
+	err := s.db.QueryRow(
+		"SELECT scopes FROM personal_access_tokens WHERE id = $1",
+		strings.TrimPrefix(session.Id, patSessionPrefix),
+	).Scan(pq.Array(&scopes))
+	return scopes, err
+}
+
+// isSystemAdminSession reports whether the session may act as a system
+// admin. PATs of system admins only may with the admin scope.
+func (s *Server) isSystemAdminSession(session *client.Session) bool {
+	if !s.isSystemAdmin(session.Identity.Id) {
+		return false
+	}
+	if !isPATSession(session) {
+		return true
+	}
+
+	scopes, err := s.patScopes(session)
+	if err != nil {
+		logError("Failed to load scopes of PAT %s: %v", session.Id, err)
+		return false
+	}
+	return patScopeAllows(scopes, patScopeAdmin)
+}
+
+// writeSystemAdminForbidden answers a failed isSystemAdminSession check.
+// System admins whose PAT lacks the admin scope are told so.
+func (s *Server) writeSystemAdminForbidden(w http.ResponseWriter, session *client.Session, code string) {
+	if isPATSession(session) && s.isSystemAdmin(session.Identity.Id) {
+		logAuth("PAT %s lacks admin scope for system admin access", session.Id)
+		WriteError(w, http.StatusForbidden, ErrCodeForbidden,
+			fmt.Sprintf("Forbidden - token requires the %s scope", patScopeAdmin))
+		return
+	}
+	WriteError(w, http.StatusForbidden, code, "Forbidden - System admin access required")
+}
+
+// createPAT issues a token for the caller. The plaintext is only returned
+// here. Tokens can't be created with an API key or another token.
+func (s *Server) createPAT(w http.ResponseWriter, r *http.Request) {
+	logInfo("Processing create personal access token request")
+
+	session, err := s.getSessionFromRequest(r)
+	if err != nil {
+		logAuth("Unauthorized create PAT: %v", err)
+		WriteError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	userID := mux.Vars(r)["id"]
+	if session.Identity.Id != userID {
+		logAuth("User %s tried to create a PAT for %s", session.Identity.Id, userID)
+		WriteError(w, http.StatusForbidden, ErrCodeForbidden, "Forbidden - You can only create your own tokens")
+		return
+	}
+	if isAPIKeySession(session) || isPATSession(session) {
+		logAuth("Token session for %s attempted to create a PAT", session.Identity.Id)
+		WriteError(w, http.StatusForbidden, ErrCodeForbidden, "Personal access tokens can only be created from a login session")
+		return
+	}
+
+	req, ok := decodeAndValidate[CreatePATRequest](w, r)
+	if !ok {
+		return
+	}
+	if req.ExpiresInDays < 0 {
+		WriteError(w, http.StatusBadRequest, ErrCodeValidationFailed, "expires_in_days: must not be negative")
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{patScopeRead}
+	}
+	for _, scope := range req.Scopes {
+		if err := validateRole(scope, []string{patScopeRead, patScopeWrite, patScopeAdmin}); err != nil {
+			WriteError(w, http.StatusBadRequest, ErrCodeValidationFailed,
+				fmt.Sprintf("scopes: invalid scope %q, must be one of: read, write, admin", scope))
+			return
+		}
+	}
+
+	plaintext, hash, err := generatePAT()
+	if err != nil {
+		logError("Failed to generate PAT: %v", err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to create token")
+		return
+	}
+
+	pat := PersonalAccessToken{
+		UserID: userID,
+		Name:   req.Name,
+		Prefix: plaintext[:patPrefixLength],
+		Scopes: req.Scopes,
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := time.Now().Add(time.Duration(req.ExpiresInDays) * 24 * time.Hour)
+		pat.ExpiresAt = &expiresAt
+	}
+
+	// The token references the local user row, normally saved on login
+	s.saveUserProfile(session.Identity)
+
+	err = s.db.QueryRow(`
+		INSERT INTO personal_access_tokens (user_id, name, token_hash, prefix, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`,
+		pat.UserID, pat.Name, hash, pat.Prefix, pq.Array(pat.Scopes), pat.ExpiresAt,
+	).Scan(&pat.ID, &pat.CreatedAt)
+	if err != nil {
+		logError("Failed to store PAT: %v", err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to create token")
+		return
+	}
+
+	logAuth("PAT %s (%s...) created for user %s with scopes %v", pat.ID, pat.Prefix, userID, pat.Scopes)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token_info": pat,
+		"token":      plaintext,
+		"warning":    "Store this token now. It cannot be retrieved again.",
+	})
+}
+
+// listPATs lists a user's tokens, newest first, without hashes. System
+// admins can list anyone's.
+func (s *Server) listPATs(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSessionFromRequest(r)
+	if err != nil {
+		logAuth("Unauthorized list PATs: %v", err)
+		WriteError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	userID := mux.Vars(r)["id"]
+	if session.Identity.Id != userID && !s.isSystemAdminSession(session) {
+		logAuth("User %s not authorized to list PATs of %s", session.Identity.Id, userID)
+		WriteError(w, http.StatusForbidden, ErrCodeForbidden, "Forbidden")
+		return
+	}
+
+	tokens, err := s.getUserPATs(userID)
+	if err != nil {
+		logError("Failed to fetch PATs of user %s: %v", userID, err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch tokens")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// getUserPATs returns the user's tokens, newest first. Only metadata is
+// read; the hash never leaves the database.
+func (s *Server) getUserPATs(userID string) ([]PersonalAccessToken, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at
+		FROM personal_access_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []PersonalAccessToken{}
+	for rows.Next() {
+		var pat PersonalAccessToken
+		var expiresAt, lastUsedAt sql.NullTime
+		err := rows.Scan(&pat.ID, &pat.UserID, &pat.Name, &pat.Prefix, pq.Array(&pat.Scopes),
+			&expiresAt, &lastUsedAt, &pat.CreatedAt)
+		if err != nil {
+			logWarning("Error scanning PAT row: %v", err)
+			continue
+		}
+		if expiresAt.Valid {
+			pat.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			pat.LastUsedAt = &lastUsedAt.Time
+		}
+		tokens = append(tokens, pat)
+	}
+	return tokens, rows.Err()
+}
+
+// deletePAT revokes a token by deleting it. System admins can delete
+// anyone's.
+func (s *Server) deletePAT(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSessionFromRequest(r)
+	if err != nil {
+		logAuth("Unauthorized delete PAT: %v", err)
+		WriteError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	vars := mux.Vars(r)
+	userID := vars["id"]
+	tokenID := vars["tokenId"]
+
+	if session.Identity.Id != userID && !s.isSystemAdminSession(session) {
+		logAuth("User %s not authorized to delete PATs of %s", session.Identity.Id, userID)
+		WriteError(w, http.StatusForbidden, ErrCodeForbidden, "Forbidden")
+		return
+	}
+	if validateUUID(tokenID) != nil {
+		WriteError(w, http.StatusNotFound, ErrCodeNotFound, "Token not found")
+		return
+	}
+
+	result, err := s.db.Exec(
+		"DELETE FROM personal_access_tokens WHERE id = $1 AND user_id = $2",
+		tokenID, userID,
+	)
+	if err != nil {
+		logError("Failed to delete PAT %s: %v", tokenID, err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to delete token")
+		return
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		WriteError(w, http.StatusNotFound, ErrCodeNotFound, "Token not found")
+		return
+	}
+
+	logAuth("PAT %s of user %s deleted by %s", tokenID, userID, session.Identity.Id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	client "github.com/ory/kratos-client-go"
+)
+
+func TestRedactToken(t *testing.T) {
+	pat, _, err := generatePAT()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := redactToken(pat)
+	if got != pat[:patPrefixLength]+"..." {
+		t.Errorf("redactToken(PAT) = %q, want only the stored prefix", got)
+	}
+
+	if got := redactToken("ory_st_abcdefghijklmnopqrstuvwxyz"); got != "ory_st_abcdefghijklm..." {
+		t.Errorf("redactToken(session token) = %q", got)
+	}
+	if got := redactToken("short"); got != "short..." {
+		t.Errorf("redactToken(short) = %q", got)
+	}
+}
+
+func TestRequiredPATScope(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		{"GET", "/api/organizations", patScopeRead},
+		{"HEAD", "/api/organizations", patScopeRead},
+		{"OPTIONS", "/api/organizations", patScopeRead},
+		{"POST", "/api/organizations", patScopeWrite},
+		{"PUT", "/api/users/" + testUserID + "/permissions", patScopeWrite},
+		{"DELETE", "/api/users/" + testUserID, patScopeWrite},
+		{"GET", "/api/admin/organizations", patScopeRead},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := requiredPATScope(r); got != tt.want {
+			t.Errorf("requiredPATScope(%s %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPATScopeAllows(t *testing.T) {
+	tests := []struct {
+		scopes   []string
+		required string
+		want     bool
+	}{
+		{nil, patScopeRead, false},
+		{[]string{patScopeRead}, patScopeRead, true},
+		{[]string{patScopeRead}, patScopeWrite, false},
+		{[]string{patScopeWrite}, patScopeRead, true},
+		{[]string{patScopeWrite}, patScopeAdmin, false},
+		{[]string{patScopeRead, patScopeAdmin}, patScopeWrite, true},
+		{[]string{patScopeAdmin}, patScopeAdmin, true},
+		{[]string{"unknown"}, patScopeRead, false},
+	}
+
+	for _, tt := range tests {
+		if got := patScopeAllows(tt.scopes, tt.required); got != tt.want {
+			t.Errorf("patScopeAllows(%v, %q) = %t, want %t", tt.scopes, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestSystemAdminHandlerRequiresAdminScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes string
+		status int
+	}{
+		// The update matches no user, so passing the admin check ends in 404
+		{"write scope", "{write}", http.StatusForbidden},
+		{"admin scope", "{admin}", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, fake := newFakeDB(t,
+				fakeQuery{match: "SELECT scopes FROM personal_access_tokens", columns: []string{"scopes"},
+					rows: [][]driver.Value{{tt.scopes}}},
+				fakeQuery{match: "UPDATE users SET can_create_organizations"},
+			)
+			s := newTestServer(t, db, http.NotFoundHandler())
+			s.cfg.SystemAdminIDs = []string{testOwnerID}
+
+			r := httptest.NewRequest("PUT", "/api/users/"+testUserID+"/permissions",
+				strings.NewReader(`{"can_create_organizations": true}`))
+			session := &client.Session{Id: patSessionPrefix + "token", Identity: client.Identity{Id: testOwnerID}}
+			r = r.WithContext(context.WithValue(r.Context(), sessionKey, sessionResult{session: session}))
+			r = mux.SetURLVars(r, map[string]string{"id": testUserID})
+			w := httptest.NewRecorder()
+			s.updateUserPermissions(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusForbidden {
+				if !strings.Contains(w.Body.String(), "admin scope") {
+					t.Errorf("body = %s, want the missing admin scope named", w.Body)
+				}
+				if fake.executed("UPDATE users") {
+					t.Error("permissions updated through a PAT without the admin scope")
+				}
+			}
+		})
+	}
+}
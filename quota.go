@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Resources an organization can have a quota on
+const (
+	quotaTenants = "tenants"
+	quotaTeams   = "teams"
+	quotaMembers = "members"
+)
+
+var quotaResources = []string{quotaTenants, quotaTeams, quotaMembers}
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// OrgQuota is the limit on one resource of an organization together with
+// its current usage. MaxCount is nil when the resource is unlimited.
+type OrgQuota struct {
+	ResourceType string     `json:"resource_type" validate:"required,oneof=tenants teams members"`
+	MaxCount     *int       `json:"max_count"`
+	CurrentCount int        `json:"current_count"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+}
+
+// countQuotaUsage returns how much of resource orgID uses. Usage is counted
+// from the resource tables rather than tracked, so it can't drift.
+func countQuotaUsage(q sqlQueryer, orgID, resource string) (int, error) {
+	var count int
+	var err error
+	switch resource {
+	case quotaTenants:
+		err = q.QueryRow(`
+			SELECT COUNT(*) FROM organizations
+			WHERE org_id = $1 AND org_type = 'tenant' AND deleted_at IS NULL`,
+			orgID,
+		).Scan(&count)
+	case quotaTeams:
+		err = q.QueryRow("SELECT COUNT(*) FROM teams WHERE org_id = $1", orgID).Scan(&count)
+	case quotaMembers:
+		count, err = countOrgMembers(q, orgID)
+	default:
+		err = fmt.Errorf("unknown quota resource %q", resource)
+	}
+	return count, err
+}
+
+// getQuotaLimit returns orgID's limit on resource, or nil if it has none.
+// Tenants are also limited by the max_tenant_count feature flag; the lower
+// of the two applies.
+func getQuotaLimit(q sqlQueryer, orgID, resource string) (*int, error) {
+	var limit *int
+	var maxCount int
+	err := q.QueryRow(`
+		SELECT max_count FROM organization_quotas
+		WHERE org_id = $1 AND resource_type = $2`,
+		orgID, resource,
+	).Scan(&maxCount)
+	switch {
+	case err == nil:
+		limit = &maxCount
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+
+	if resource == quotaTenants {
+		featureLimit, err := getMaxTenantCount(q, orgID)
+		if err != nil {
+			return nil, err
+		}
+		if featureLimit != nil && (limit == nil || *featureLimit < *limit) {
+			limit = featureLimit
+		}
+	}
+	return limit, nil
+}
+
+// checkQuotaTx returns errQuotaExceeded if orgID can't have one more of
+// resource. The organization row is locked so concurrent creations are
+// checked one at a time.
+func checkQuotaTx(tx *sql.Tx, orgID, resource string) error {
+	limit, err := getQuotaLimit(tx, orgID, resource)
+	if err != nil || limit == nil {
+		return err
+	}
+
+	if _, err = tx.Exec("SELECT id FROM organizations WHERE id = $1 FOR UPDATE", orgID); err != nil {
+		return err
+	}
+
+	used, err := countQuotaUsage(tx, orgID, resource)
+	if err != nil {
+		return err
+	}
+	if used >= *limit {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// getOrgQuotas returns every quota resource of orgID with its limit and usage
+func (s *Server) getOrgQuotas(orgID string) ([]OrgQuota, error) {
+	rows, err := s.db.Query(`
+		SELECT resource_type, max_count, updated_at
+		FROM organization_quotas
+		WHERE org_id = $1`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]OrgQuota)
+	for rows.Next() {
+		var quota OrgQuota
+		var maxCount int
+		var updatedAt time.Time
+		if err := rows.Scan(&quota.ResourceType, &maxCount, &updatedAt); err != nil {
+			return nil, err
+		}
+		quota.MaxCount = &maxCount
+		quota.UpdatedAt = &updatedAt
+		stored[quota.ResourceType] = quota
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	quotas := make([]OrgQuota, 0, len(quotaResources))
+	for _, resource := range quotaResources {
+		quota, ok := stored[resource]
+		if !ok {
+			quota = OrgQuota{ResourceType: resource}
+		}
+		if quota.CurrentCount, err = countQuotaUsage(s.db, orgID, resource); err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, quota)
+	}
+	return quotas, nil
+}
+
+// getOrgQuotaHandler lists an organization's quotas and usage. Organization
+// admins and system admins can read them.
+func (s *Server) getOrgQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	session, err := s.getSessionFromRequest(r)
+	if err != nil {
+		logAuth("Unauthorized get quota: %v", err)
+		WriteError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	orgID := mux.Vars(r)["id"]
+
+	if !s.isOrgAdmin(session.Identity.Id, orgID) && !s.isSystemAdminSession(session) {
+		logAuth("User %s not authorized to read quotas of organization %s", session.Identity.Id, orgID)
+		WriteError(w, http.StatusForbidden, ErrCodeForbidden, "Forbidden - Admin access required")
+		return
+	}
+
+	quotas, err := s.getOrgQuotas(orgID)
+	if err != nil {
+		logError("Failed to fetch quotas for organization %s: %v", orgID, err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch organization quotas")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"quotas": quotas})
+}
+
+// updateOrgQuota sets or clears (max_count null) the given quotas. Quotas
+// left out of the request are unchanged. Only system admins can set quotas.
+func (s *Server) updateOrgQuota(w http.ResponseWriter, r *http.Request) {
+	logInfo("Processing update organization quota request")
+
+	session, err := s.getSessionFromRequest(r)
+	if err != nil {
+		logAuth("Unauthorized update quota: %v", err)
+		WriteError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return
+	}
+
+	if !s.isSystemAdminSession(session) {
+		logAuth("User %s not authorized to update quotas - system admin required", session.Identity.Id)
+		s.writeSystemAdminForbidden(w, session, ErrCodeForbidden)
+		return
+	}
+
+	orgID := mux.Vars(r)["id"]
+
+	var req []OrgQuota
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logWarning("Invalid request body for organization quota: %v", err)
+		WriteError(w, http.StatusBadRequest, ErrCodeBadRequest, "Invalid request body")
+		return
+	}
+	if len(req) == 0 {
+		WriteError(w, http.StatusBadRequest, ErrCodeBadRequest, "No quotas to update")
+		return
+	}
+	for i := range req {
+		if errs := validateStruct(&req[i]); len(errs) > 0 {
+			WriteError(w, http.StatusBadRequest, ErrCodeValidationFailed, fmt.Sprintf("[%d].%s", i, errs[0].Error()))
+			return
+		}
+		if req[i].MaxCount != nil && *req[i].MaxCount < 0 {
+			WriteError(w, http.StatusBadRequest, ErrCodeValidationFailed, fmt.Sprintf("[%d].max_count: must not be negative", i))
+			return
+		}
+	}
+
+	org, err := s.getOrganizationFromDB(orgID)
+	if err != nil {
+		logError("Failed to fetch organization %s: %v", orgID, err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update organization quota")
+		return
+	}
+	if org == nil {
+		WriteError(w, http.StatusNotFound, ErrCodeNotFound, "Organization not found")
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		logError("Failed to start transaction: %v", err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update organization quota")
+		return
+	}
+	defer tx.Rollback()
+
+	changed := make(map[string]interface{}, len(req))
+	for _, quota := range req {
+		if quota.MaxCount == nil {
+			_, err = tx.Exec(`
+				DELETE FROM organization_quotas WHERE org_id = $1 AND resource_type = $2`,
+				orgID, quota.ResourceType,
+			)
+		} else {
+			used, countErr := countQuotaUsage(tx, orgID, quota.ResourceType)
+			if countErr != nil {
+				logError("Failed to count %s of organization %s: %v", quota.ResourceType, orgID, countErr)
+				WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update organization quota")
+				return
+			}
+			if *quota.MaxCount < used {
+				logWarning("Rejected %s quota %d for organization %s using %d", quota.ResourceType, *quota.MaxCount, orgID, used)
+				WriteError(w, http.StatusBadRequest, ErrCodeValidationFailed,
+					fmt.Sprintf("%s: max_count must be at least the current usage (%d)", quota.ResourceType, used))
+				return
+			}
+			_, err = tx.Exec(`
+				INSERT INTO organization_quotas (org_id, resource_type, max_count)
+				VALUES ($1, $2, $3)
+				ON CONFLICT (org_id, resource_type)
+				DO UPDATE SET max_count = $3, updated_at = CURRENT_TIMESTAMP`,
+				orgID, quota.ResourceType, *quota.MaxCount,
+			)
+		}
+		if err != nil {
+			logError("Failed to store %s quota for organization %s: %v", quota.ResourceType, orgID, err)
+			WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update organization quota")
+			return
+		}
+		changed[quota.ResourceType] = quota.MaxCount
+	}
+
+	if err = recordOrgAudit(tx, orgID, session.Identity.Id, auditQuotaUpdated, "", changed); err != nil {
+		logError("Failed to audit quota change: %v", err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update organization quota")
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		logError("Failed to commit quota change: %v", err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update organization quota")
+		return
+	}
+
+	quotas, err := s.getOrgQuotas(orgID)
+	if err != nil {
+		logError("Failed to fetch quotas for organization %s: %v", orgID, err)
+		WriteError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch organization quotas")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"quotas": quotas})
+
+	logSuccess("Quotas updated for organization %s by %s", orgID, session.Identity.Id)
+}
@@ -0,0 +1,931 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	client "github.com/ory/kratos-client-go"
+)
+
+// SCIM 2.0 (RFC 7643/7644) provisioning for identity providers such as Okta
+// and Azure AD. Requests authenticate with HTTP Basic auth whose password is
+// SCIM_TOKEN; the username is ignored.
+
+const (
+	scimSchemaUser         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaGroup        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaListResponse = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaError        = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	scimContentType     = "application/scim+json"
+	scimDefaultCount    = 100
+	scimMaxCount        = 500
+	kratosDefaultSchema = "default"
+)
+
+// Only the filters IdPs send when matching existing resources are supported
+var (
+	scimUserNameFilter    = regexp.MustCompile(`^(?i)userName\s+eq\s+"([^"]*)"$`)
+	scimDisplayNameFilter = regexp.MustCompile(`^(?i)displayName\s+eq\s+"([^"]*)"$`)
+	scimMemberPathFilter  = regexp.MustCompile(`^(?i)members\[value\s+eq\s+"([^"]*)"\]$`)
+)
+
+type SCIMName struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type SCIMMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	LastModified *time.Time `json:"lastModified,omitempty"`
+	Location     string     `json:"location,omitempty"`
+}
+
+type SCIMUser struct {
+	Schemas    []string    `json:"schemas"`
+	ID         string      `json:"id,omitempty"`
+	ExternalID string      `json:"externalId,omitempty"`
+	UserName   string      `json:"userName"`
+	Name       SCIMName    `json:"name"`
+	Emails     []SCIMEmail `json:"emails,omitempty"`
+	Active     *bool       `json:"active,omitempty"`
+	Meta       *SCIMMeta   `json:"meta,omitempty"`
+}
+
+// SCIMGroup is an organization; its members are the organization's members
+type SCIMGroup struct {
+	Schemas     []string          `json:"schemas"`
+	ID          string            `json:"id,omitempty"`
+	ExternalID  string            `json:"externalId,omitempty"`
+	DisplayName string            `json:"displayName"`
+	Members     []SCIMGroupMember `json:"members,omitempty"`
+	Meta        *SCIMMeta         `json:"meta,omitempty"`
+}
+
+type SCIMGroupMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type SCIMPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+type SCIMPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type SCIMListResponse struct {
+	Schemas      []string    `json:"schemas"`
+	TotalResults int         `json:"totalResults"`
+	StartIndex   int         `json:"startIndex"`
+	ItemsPerPage int         `json:"itemsPerPage"`
+	Resources    interface{} `json:"Resources"`
+}
+
+// requireSCIMToken rejects requests whose Basic auth password is not
+// SCIM_TOKEN. SCIM is disabled while the token is unset.
+func (s *Server) requireSCIMToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := s.config().SCIMToken
+		if token == "" {
+			writeSCIMError(w, http.StatusNotFound, "", "SCIM provisioning is not enabled")
+			return
+		}
+
+		_, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(token)) != 1 {
+			logAuth("Rejected SCIM request to %s with invalid credentials", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Basic realm="scim"`)
+			writeSCIMError(w, http.StatusUnauthorized, "", "Invalid SCIM credentials")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// scimGroupEnabled reports whether the organization behind a group has
+// enable_scim on, writing the error response if not. Users and new groups
+// aren't tied to an existing organization, so SCIM_TOKEN alone guards them.
+func (s *Server) scimGroupEnabled(w http.ResponseWriter, orgID string) bool {
+	enabled, err := s.hasFeature(orgID, featureEnableSCIM)
+	if err != nil {
+		logError("Failed to check SCIM feature of organization %s: %v", orgID, err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to check group")
+		return false
+	}
+	if !enabled {
+		logAuth("Rejected SCIM request for organization %s: SCIM is disabled for it", orgID)
+		writeSCIMError(w, http.StatusForbidden, "", "SCIM provisioning is not enabled for this group")
+		return false
+	}
+	return true
+}
+
+// scimListUsers handles GET /scim/v2/Users
+func (s *Server) scimListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	startIndex, count := scimPagination(query.Get("startIndex"), query.Get("count"))
+
+	where := ""
+	args := []interface{}{}
+	if filter := strings.TrimSpace(query.Get("filter")); filter != "" {
+		match := scimUserNameFilter.FindStringSubmatch(filter)
+		if match == nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidFilter", "Only userName eq filters are supported")
+			return
+		}
+		where = "WHERE LOWER(email) = LOWER($1)"
+		args = append(args, match[1])
+	}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM users "+where, args...).Scan(&total); err != nil {
+		logError("Failed to count SCIM users: %v", err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to list users")
+		return
+	}
+
+	args = append(args, count, startIndex-1)
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT id, email, first_name, last_name, created_at, updated_at
+		FROM users %s
+		ORDER BY created_at, id
+		LIMIT $%d OFFSET $%d`, where, len(args)-1, len(args)),
+		args...,
+	)
+	if err != nil {
+		logError("Failed to list SCIM users: %v", err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to list users")
+		return
+	}
+	defer rows.Close()
+
+	users := []SCIMUser{}
+	for rows.Next() {
+		var user User
+		var createdAt, updatedAt sql.NullTime
+		if err := rows.Scan(&user.ID, &user.Email, &user.FirstName, &user.LastName, &createdAt, &updatedAt); err != nil {
+			logWarning("Error scanning SCIM user row: %v", err)
+			continue
+		}
+		users = append(users, toSCIMUser(user, createdAt, updatedAt))
+	}
+
+	writeSCIM(w, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimSchemaListResponse},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(users),
+		Resources:    users,
+	})
+}
+
+// scimCreateUser handles POST /scim/v2/Users by creating the identity in
+// Kratos and mirroring it into the users table
+func (s *Server) scimCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req SCIMUser
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request body")
+		return
+	}
+
+	email := strings.TrimSpace(req.UserName)
+	if validateEmail(email) != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "userName must be an email address")
+		return
+	}
+
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email) = LOWER($1))", email).Scan(&exists)
+	if err != nil {
+		logError("Failed to check for existing SCIM user %s: %v", email, err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to create user")
+		return
+	}
+	if exists {
+		writeSCIMError(w, http.StatusConflict, "uniqueness", "A user with this userName already exists")
+		return
+	}
+
+	traits := map[string]interface{}{
+		"email": email,
+		"name": map[string]interface{}{
+			"first": req.Name.GivenName,
+			"last":  req.Name.FamilyName,
+		},
+	}
+	body := client.NewCreateIdentityBody(kratosDefaultSchema, traits)
+	if req.Active != nil && !*req.Active {
+		body.SetState(client.IDENTITYSTATE_INACTIVE)
+	}
+
+	identity, resp, err := s.kratosAdmin.IdentityApi.CreateIdentity(context.Background()).CreateIdentityBody(*body).Execute()
+	defer closeKratosResponse(resp)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusConflict {
+			writeSCIMError(w, http.StatusConflict, "uniqueness", "A user with this userName already exists")
+			return
+		}
+		logError("Failed to create Kratos identity for SCIM user %s: %v (status: %d)", email, err, kratosStatus(resp))
+		writeSCIMError(w, http.StatusBadGateway, "", "Failed to create user")
+		return
+	}
+
+	user := s.mapIdentityToUser(*identity)
+	var createdAt, updatedAt sql.NullTime
+	err = s.db.QueryRow(`
+		INSERT INTO users (id, email, first_name, last_name)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET
+			email = $2,
+			first_name = $3,
+			last_name = $4,
+			updated_at = CURRENT_TIMESTAMP
+		RETURNING created_at, updated_at`,
+		user.ID, user.Email, user.FirstName, user.LastName,
+	).Scan(&createdAt, &updatedAt)
+	if err != nil {
+		logError("Failed to save SCIM user %s: %v", identity.Id, err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to create user")
+		return
+	}
+
+	logSuccess("Provisioned user %s (%s) via SCIM", user.ID, user.Email)
+
+	scimUser := toSCIMUser(user, createdAt, updatedAt)
+	scimUser.ExternalID = req.ExternalID
+	if req.Active != nil {
+		scimUser.Active = req.Active
+	}
+	w.Header().Set("Location", scimUser.Meta.Location)
+	writeSCIM(w, http.StatusCreated, scimUser)
+}
+
+// scimListGroups handles GET /scim/v2/Groups. Members are left out of the
+// listing; fetch a single group to get them. Organizations with SCIM
+// disabled are not listed.
+func (s *Server) scimListGroups(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	startIndex, count := scimPagination(query.Get("startIndex"), query.Get("count"))
+
+	where := `WHERE deleted_at IS NULL AND NOT EXISTS (
+		SELECT 1 FROM organization_features f
+		WHERE f.org_id = organizations.id AND f.feature_name = '` + featureEnableSCIM + `' AND NOT f.enabled)`
+	args := []interface{}{}
+	if filter := strings.TrimSpace(query.Get("filter")); filter != "" {
+		match := scimDisplayNameFilter.FindStringSubmatch(filter)
+		if match == nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidFilter", "Only displayName eq filters are supported")
+			return
+		}
+		where += " AND name = $1"
+		args = append(args, match[1])
+	}
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM organizations "+where, args...).Scan(&total); err != nil {
+		logError("Failed to count SCIM groups: %v", err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to list groups")
+		return
+	}
+
+	args = append(args, count, startIndex-1)
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT id, name, created_at, updated_at
+		FROM organizations %s
+		ORDER BY created_at, id
+		LIMIT $%d OFFSET $%d`, where, len(args)-1, len(args)),
+		args...,
+	)
+	if err != nil {
+		logError("Failed to list SCIM groups: %v", err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to list groups")
+		return
+	}
+	defer rows.Close()
+
+	groups := []SCIMGroup{}
+	for rows.Next() {
+		var id, name string
+		var createdAt, updatedAt sql.NullTime
+		if err := rows.Scan(&id, &name, &createdAt, &updatedAt); err != nil {
+			logWarning("Error scanning SCIM group row: %v", err)
+			continue
+		}
+		groups = append(groups, toSCIMGroup(id, name, createdAt, updatedAt))
+	}
+
+	writeSCIM(w, http.StatusOK, SCIMListResponse{
+		Schemas:      []string{scimSchemaListResponse},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(groups),
+		Resources:    groups,
+	})
+}
+
+// scimCreateGroup handles POST /scim/v2/Groups by creating an organization
+// with no owner and adding the listed members
+func (s *Server) scimCreateGroup(w http.ResponseWriter, r *http.Request) {
+	var req SCIMGroup
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request body")
+		return
+	}
+	req.DisplayName = strings.TrimSpace(req.DisplayName)
+	if req.DisplayName == "" {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "displayName is required")
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		logError("Failed to start transaction: %v", err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to create group")
+		return
+	}
+	defer tx.Rollback()
+
+	var orgID string
+	err = tx.QueryRow(`
+		INSERT INTO organizations (org_type, name, description)
+		VALUES ('organization', $1, '')
+		ON CONFLICT (name) DO NOTHING
+		RETURNING id`,
+		req.DisplayName,
+	).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		writeSCIMError(w, http.StatusConflict, "uniqueness", "A group with this displayName already exists")
+		return
+	}
+	if err != nil {
+		logError("Failed to create organization for SCIM group %s: %v", req.DisplayName, err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to create group")
+		return
+	}
+
+	err = recordOrgAudit(tx, orgID, "", auditOrgCreated, "", map[string]interface{}{
+		"name":   req.DisplayName,
+		"source": "scim",
+	})
+	if err != nil {
+		logError("Failed to audit SCIM group creation: %v", err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to create group")
+		return
+	}
+
+	added, scimErr := s.scimAddMembers(tx, orgID, scimMemberIDs(req.Members))
+	if scimErr == scimMemberLimitReached {
+		writeSCIMError(w, http.StatusForbidden, "", scimErr)
+		return
+	}
+	if scimErr != "" {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", scimErr)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		logError("Failed to commit SCIM group creation: %v", err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to create group")
+		return
+	}
+	s.invalidateHierarchies(added...)
+
+	logSuccess("Provisioned organization %s (%s) via SCIM with %d members", orgID, req.DisplayName, len(added))
+
+	go s.dispatchWebhookEvent(orgID, webhookEventOrgCreated, map[string]interface{}{
+		"name":     req.DisplayName,
+		"org_type": "organization",
+	})
+	s.dispatchMemberEvents(orgID, webhookEventMemberAdded, added)
+
+	group, err := s.getSCIMGroup(orgID)
+	if err != nil {
+		logError("Failed to fetch SCIM group %s: %v", orgID, err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to fetch group")
+		return
+	}
+	group.ExternalID = req.ExternalID
+	w.Header().Set("Location", group.Meta.Location)
+	writeSCIM(w, http.StatusCreated, group)
+}
+
+// scimGetGroup handles GET /scim/v2/Groups/{id}
+func (s *Server) scimGetGroup(w http.ResponseWriter, r *http.Request) {
+	orgID := mux.Vars(r)["id"]
+
+	if validateUUID(orgID) != nil {
+		writeSCIMError(w, http.StatusNotFound, "", "Group not found")
+		return
+	}
+	if !s.scimGroupEnabled(w, orgID) {
+		return
+	}
+
+	group, err := s.getSCIMGroup(orgID)
+	if err == sql.ErrNoRows {
+		writeSCIMError(w, http.StatusNotFound, "", "Group not found")
+		return
+	}
+	if err != nil {
+		logError("Failed to fetch SCIM group %s: %v", orgID, err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to fetch group")
+		return
+	}
+
+	writeSCIM(w, http.StatusOK, group)
+}
+
+// scimPatchGroup handles PATCH /scim/v2/Groups/{id}. Supported operations
+// are add/remove/replace on members (including the members[value eq "id"]
+// path form) and replace on displayName.
+func (s *Server) scimPatchGroup(w http.ResponseWriter, r *http.Request) {
+	orgID := mux.Vars(r)["id"]
+
+	var req SCIMPatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "Invalid request body")
+		return
+	}
+
+	if validateUUID(orgID) != nil {
+		writeSCIMError(w, http.StatusNotFound, "", "Group not found")
+		return
+	}
+
+	if !s.scimGroupEnabled(w, orgID) {
+		return
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		logError("Failed to start transaction: %v", err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to update group")
+		return
+	}
+	defer tx.Rollback()
+
+	var ownerID sql.NullString
+	err = tx.QueryRow("SELECT owner_id FROM organizations WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", orgID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		writeSCIMError(w, http.StatusNotFound, "", "Group not found")
+		return
+	}
+	if err != nil {
+		logError("Failed to fetch organization %s for SCIM patch: %v", orgID, err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to update group")
+		return
+	}
+
+	var added, removed []string
+	for _, op := range req.Operations {
+		path := strings.TrimSpace(op.Path)
+		var opAdded, opRemoved []string
+		scimErr := ""
+
+		switch strings.ToLower(op.Op) {
+		case "add":
+			if !strings.EqualFold(path, "members") {
+				scimErr = "add is only supported on members"
+				break
+			}
+			var members []SCIMGroupMember
+			if json.Unmarshal(op.Value, &members) != nil {
+				scimErr = "members must be a list of {value}"
+				break
+			}
+			opAdded, scimErr = s.scimAddMembers(tx, orgID, scimMemberIDs(members))
+
+		case "remove":
+			var ids []string
+			if match := scimMemberPathFilter.FindStringSubmatch(path); match != nil {
+				ids = []string{match[1]}
+			} else if strings.EqualFold(path, "members") {
+				var members []SCIMGroupMember
+				if len(op.Value) > 0 && json.Unmarshal(op.Value, &members) != nil {
+					scimErr = "members must be a list of {value}"
+					break
+				}
+				// Without a value every member is removed
+				ids = scimMemberIDs(members)
+				if len(op.Value) == 0 {
+					ids, err = s.scimCurrentMemberIDs(tx, orgID)
+				}
+			} else {
+				scimErr = "remove is only supported on members"
+				break
+			}
+			if err == nil {
+				opRemoved, scimErr, err = scimRemoveMembers(tx, orgID, ids, ownerID.String)
+			}
+
+		case "replace":
+			var value struct {
+				DisplayName *string            `json:"displayName"`
+				Members     *[]SCIMGroupMember `json:"members"`
+			}
+			switch {
+			case strings.EqualFold(path, "members"):
+				var members []SCIMGroupMember
+				if json.Unmarshal(op.Value, &members) != nil {
+					scimErr = "members must be a list of {value}"
+					break
+				}
+				value.Members = &members
+			case strings.EqualFold(path, "displayName"):
+				var name string
+				if json.Unmarshal(op.Value, &name) != nil {
+					scimErr = "displayName must be a string"
+					break
+				}
+				value.DisplayName = &name
+			case path == "":
+				if json.Unmarshal(op.Value, &value) != nil {
+					scimErr = "value must be an object"
+				}
+			default:
+				scimErr = fmt.Sprintf("replace is not supported on %s", path)
+			}
+			if scimErr != "" {
+				break
+			}
+
+			if value.DisplayName != nil {
+				scimErr, err = scimRenameGroup(tx, orgID, strings.TrimSpace(*value.DisplayName))
+			}
+			if scimErr == "" && err == nil && value.Members != nil {
+				opAdded, opRemoved, scimErr, err = s.scimReplaceMembers(tx, orgID, scimMemberIDs(*value.Members), ownerID.String)
+			}
+
+		default:
+			scimErr = fmt.Sprintf("unsupported op %q", op.Op)
+		}
+
+		if err != nil {
+			logError("Failed to apply SCIM patch to organization %s: %v", orgID, err)
+			writeSCIMError(w, http.StatusInternalServerError, "", "Failed to update group")
+			return
+		}
+		if scimErr == scimMemberLimitReached {
+			writeSCIMError(w, http.StatusForbidden, "", scimErr)
+			return
+		}
+		if scimErr != "" {
+			scimType := "invalidValue"
+			if strings.HasPrefix(scimErr, "A group") {
+				scimType = "uniqueness"
+			}
+			writeSCIMError(w, http.StatusBadRequest, scimType, scimErr)
+			return
+		}
+		added = append(added, opAdded...)
+		removed = append(removed, opRemoved...)
+	}
+
+	if err = tx.Commit(); err != nil {
+		logError("Failed to commit SCIM patch to organization %s: %v", orgID, err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to update group")
+		return
+	}
+	// A displayName change renames the organization for every member
+	s.clearHierarchies()
+
+	logSuccess("SCIM patch applied to organization %s: %d added, %d removed", orgID, len(added), len(removed))
+	s.dispatchMemberEvents(orgID, webhookEventMemberAdded, added)
+	s.dispatchMemberEvents(orgID, webhookEventMemberRemoved, removed)
+
+	group, err := s.getSCIMGroup(orgID)
+	if err != nil {
+		logError("Failed to fetch SCIM group %s: %v", orgID, err)
+		writeSCIMError(w, http.StatusInternalServerError, "", "Failed to fetch group")
+		return
+	}
+	writeSCIM(w, http.StatusOK, group)
+}
+
+func (s *Server) getSCIMGroup(orgID string) (SCIMGroup, error) {
+	if validateUUID(orgID) != nil {
+		return SCIMGroup{}, sql.ErrNoRows
+	}
+
+	var name string
+	var createdAt, updatedAt sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT name, created_at, updated_at FROM organizations WHERE id = $1 AND deleted_at IS NULL`,
+		orgID,
+	).Scan(&name, &createdAt, &updatedAt)
+	if err != nil {
+		return SCIMGroup{}, err
+	}
+	group := toSCIMGroup(orgID, name, createdAt, updatedAt)
+
+	members, err := s.getOrgMembers(orgID)
+	if err != nil {
+		return SCIMGroup{}, err
+	}
+	group.Members = []SCIMGroupMember{}
+	for _, member := range members {
+		group.Members = append(group.Members, SCIMGroupMember{
+			Value:   member.UserID,
+			Display: member.Email,
+			Ref:     "/scim/v2/Users/" + member.UserID,
+		})
+	}
+	return group, nil
+}
+
+// scimMemberLimitReached is the SCIM error message for additions that would
+// take an organization past its member limit
+const scimMemberLimitReached = "organization member limit reached"
+
+// scimAddMembers links the given users to the organization as members.
+// Users that are not provisioned yet, or more users than the organization's
+// member limit allows, are rejected with a SCIM error message rather than
+// an error.
+func (s *Server) scimAddMembers(tx *sql.Tx, orgID string, userIDs []string) ([]string, string) {
+	for _, userID := range userIDs {
+		if validateUUID(userID) != nil {
+			return nil, fmt.Sprintf("unknown member %q", userID)
+		}
+
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", userID).Scan(&exists); err != nil || !exists {
+			return nil, fmt.Sprintf("unknown member %q", userID)
+		}
+	}
+
+	exceeded, err := s.memberLimitExceededTx(tx, orgID, userIDs)
+	if err != nil {
+		logError("Failed to check member limit of organization %s: %v", orgID, err)
+		return nil, "failed to add members"
+	}
+	if exceeded {
+		logWarning("Organization %s has reached its member limit, rejecting SCIM members", orgID)
+		return nil, scimMemberLimitReached
+	}
+
+	added := []string{}
+	for _, userID := range userIDs {
+		result, err := tx.Exec(`
+			INSERT INTO user_organization_links (user_id, organization_id, role)
+			VALUES ($1, $2, 'member')
+			ON CONFLICT (user_id, organization_id) DO NOTHING`,
+			userID, orgID,
+		)
+		if err != nil {
+			logError("Failed to add SCIM member %s to organization %s: %v", userID, orgID, err)
+			return nil, fmt.Sprintf("failed to add member %q", userID)
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			continue
+		}
+
+		err = recordOrgAudit(tx, orgID, "", auditMemberAdded, userID, map[string]interface{}{
+			"role":   "member",
+			"source": "scim",
+		})
+		if err != nil {
+			logError("Failed to audit SCIM member addition: %v", err)
+			return nil, fmt.Sprintf("failed to add member %q", userID)
+		}
+		added = append(added, userID)
+	}
+	return added, ""
+}
+
+// scimLastAdmin is the SCIM error message for removals that would leave an
+// organization without an admin
+const scimLastAdmin = "cannot remove the last admin from an organization"
+
+// scimRemoveMembers unlinks the given users. The organization owner is never
+// removed through SCIM, and removals that would leave no admin are rejected
+// with a SCIM error message.
+func scimRemoveMembers(tx *sql.Tx, orgID string, userIDs []string, ownerID string) ([]string, string, error) {
+	adminsBefore, err := countOrgAdminsTx(tx, orgID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	removed := []string{}
+	for _, userID := range userIDs {
+		if userID == ownerID || validateUUID(userID) != nil {
+			continue
+		}
+
+		result, err := tx.Exec(`
+			DELETE FROM user_organization_links
+			WHERE organization_id = $1 AND user_id = $2`,
+			orgID, userID,
+		)
+		if err != nil {
+			return nil, "", err
+		}
+		if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+			continue
+		}
+
+		err = recordOrgAudit(tx, orgID, "", auditMemberRemoved, userID, map[string]interface{}{"source": "scim"})
+		if err != nil {
+			return nil, "", err
+		}
+		removed = append(removed, userID)
+	}
+
+	admins, err := countOrgAdminsTx(tx, orgID)
+	if err != nil {
+		return nil, "", err
+	}
+	if adminsBefore > 0 && admins == 0 {
+		logWarning("Refusing SCIM removal that would leave organization %s without an admin", orgID)
+		return nil, scimLastAdmin, nil
+	}
+	return removed, "", nil
+}
+
+// scimReplaceMembers makes the organization's members exactly userIDs,
+// apart from the owner who always stays. Like scimRemoveMembers it won't
+// drop the last admin.
+func (s *Server) scimReplaceMembers(tx *sql.Tx, orgID string, userIDs []string, ownerID string) (added, removed []string, scimErr string, err error) {
+	current, err := s.scimCurrentMemberIDs(tx, orgID)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	wanted := make(map[string]bool, len(userIDs))
+	for _, id := range userIDs {
+		wanted[id] = true
+	}
+	var stale []string
+	for _, id := range current {
+		if !wanted[id] {
+			stale = append(stale, id)
+		}
+	}
+
+	if removed, scimErr, err = scimRemoveMembers(tx, orgID, stale, ownerID); err != nil || scimErr != "" {
+		return nil, nil, scimErr, err
+	}
+	added, scimErr = s.scimAddMembers(tx, orgID, userIDs)
+	return added, removed, scimErr, nil
+}
+
+func (s *Server) scimCurrentMemberIDs(tx *sql.Tx, orgID string) ([]string, error) {
+	rows, err := tx.Query("SELECT user_id FROM user_organization_links WHERE organization_id = $1", orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func scimRenameGroup(tx *sql.Tx, orgID, name string) (string, error) {
+	if name == "" {
+		return "displayName must not be empty", nil
+	}
+
+	var taken bool
+	err := tx.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM organizations WHERE name = $1 AND id != $2)`,
+		name, orgID,
+	).Scan(&taken)
+	if err != nil {
+		return "", err
+	}
+	if taken {
+		return "A group with this displayName already exists", nil
+	}
+
+	if _, err := tx.Exec("UPDATE organizations SET name = $1 WHERE id = $2", name, orgID); err != nil {
+		return "", err
+	}
+	return "", recordOrgAudit(tx, orgID, "", auditOrgUpdated, "", map[string]interface{}{
+		"name":   name,
+		"source": "scim",
+	})
+}
+
+// dispatchMemberEvents sends one membership webhook per user
+func (s *Server) dispatchMemberEvents(orgID, event string, userIDs []string) {
+	for _, userID := range userIDs {
+		go s.dispatchWebhookEvent(orgID, event, map[string]interface{}{
+			"user_id": userID,
+		})
+	}
+}
+
+func scimMemberIDs(members []SCIMGroupMember) []string {
+	ids := make([]string, 0, len(members))
+	for _, member := range members {
+		if id := strings.TrimSpace(member.Value); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func toSCIMGroup(id, name string, createdAt, updatedAt sql.NullTime) SCIMGroup {
+	group := SCIMGroup{
+		Schemas:     []string{scimSchemaGroup},
+		ID:          id,
+		DisplayName: name,
+		Meta: &SCIMMeta{
+			ResourceType: "Group",
+			Location:     "/scim/v2/Groups/" + id,
+		},
+	}
+	if createdAt.Valid {
+		group.Meta.Created = &createdAt.Time
+	}
+	if updatedAt.Valid {
+		group.Meta.LastModified = &updatedAt.Time
+	}
+	return group
+}
+
+// scimPagination parses the 1-based startIndex and count parameters
+func scimPagination(rawStart, rawCount string) (int, int) {
+	startIndex := 1
+	if v, err := strconv.Atoi(rawStart); err == nil && v > 1 {
+		startIndex = v
+	}
+	count := scimDefaultCount
+	if v, err := strconv.Atoi(rawCount); err == nil && v >= 0 {
+		count = v
+	}
+	if count > scimMaxCount {
+		count = scimMaxCount
+	}
+	return startIndex, count
+}
+
+func toSCIMUser(user User, createdAt, updatedAt sql.NullTime) SCIMUser {
+	active := true
+	scimUser := SCIMUser{
+		Schemas:  []string{scimSchemaUser},
+		ID:       user.ID,
+		UserName: user.Email,
+		Name:     SCIMName{GivenName: user.FirstName, FamilyName: user.LastName},
+		Emails:   []SCIMEmail{{Value: user.Email, Primary: true}},
+		Active:   &active,
+		Meta: &SCIMMeta{
+			ResourceType: "User",
+			Location:     "/scim/v2/Users/" + user.ID,
+		},
+	}
+	if createdAt.Valid {
+		scimUser.Meta.Created = &createdAt.Time
+	}
+	if updatedAt.Valid {
+		scimUser.Meta.LastModified = &updatedAt.Time
+	}
+	return scimUser
+}
+
+func writeSCIM(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeSCIMError responds with a SCIM error message (RFC 7644 section 3.12)
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	body := map[string]interface{}{
+		"schemas": []string{scimSchemaError},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	writeSCIM(w, status, body)
+}
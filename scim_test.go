@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSCIMPatchGroupMemberLimit(t *testing.T) {
+	const newMember = "44444444-4444-4444-4444-444444444444"
+	body := `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "add", "path": "members", "value": [{"value": "` + newMember + `"}]}]}`
+
+	tests := []struct {
+		name    string
+		members int64
+		status  int
+	}{
+		{"below limit", 1, http.StatusOK},
+		{"at limit", 2, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, fake := newFakeDB(t,
+				fakeQuery{match: "SELECT enabled FROM organization_features", columns: []string{"enabled"},
+					rows: [][]driver.Value{{true}}},
+				fakeQuery{match: "SELECT owner_id FROM organizations", columns: []string{"owner_id"},
+					rows: [][]driver.Value{{testOwnerID}}},
+				fakeQuery{match: "SELECT EXISTS(SELECT 1 FROM users", columns: []string{"exists"},
+					rows: [][]driver.Value{{true}}},
+				fakeQuery{match: "SELECT settings FROM org_settings", columns: []string{"settings"},
+					rows: [][]driver.Value{{[]byte(`{"max_members": 2}`)}}},
+				fakeQuery{match: "FROM organization_quotas", columns: []string{"max_count"}},
+				fakeQuery{match: "SELECT id FROM organizations WHERE id = $1 FOR UPDATE"},
+				fakeQuery{match: "FROM unnest($2::uuid[])", columns: []string{"current", "joining"},
+					rows: [][]driver.Value{{tt.members, int64(1)}}},
+				fakeQuery{match: "INSERT INTO user_organization_links", rows: [][]driver.Value{{}}},
+				fakeQuery{match: "INSERT INTO org_audit_log"},
+				fakeQuery{match: "SELECT name, created_at, updated_at FROM organizations", columns: []string{"name", "created_at", "updated_at"},
+					rows: [][]driver.Value{{"Acme", nil, nil}}},
+				memberRows(newMember),
+				fakeQuery{match: "FROM webhooks", columns: []string{"id"}},
+			)
+			s := newTestServer(t, db, http.NotFoundHandler())
+
+			r := httptest.NewRequest("PATCH", "/scim/v2/Groups/"+testOrgID, strings.NewReader(body))
+			r = mux.SetURLVars(r, map[string]string{"id": testOrgID})
+			w := httptest.NewRecorder()
+			s.scimPatchGroup(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (body %s)", w.Code, tt.status, w.Body)
+			}
+			if added := fake.executed("INSERT INTO user_organization_links"); added != (tt.status == http.StatusOK) {
+				t.Errorf("member inserted = %v with %d of 2 members", added, tt.members)
+			}
+		})
+	}
+}
+
+func TestSCIMGetGroupDisabled(t *testing.T) {
+	db, fake := newFakeDB(t,
+		fakeQuery{match: "SELECT enabled FROM organization_features", columns: []string{"enabled"},
+			rows: [][]driver.Value{{false}}},
+	)
+	s := newTestServer(t, db, http.NotFoundHandler())
+
+	r := httptest.NewRequest("GET", "/scim/v2/Groups/"+testOrgID, nil)
+	r = mux.SetURLVars(r, map[string]string{"id": testOrgID})
+	w := httptest.NewRecorder()
+	s.scimGetGroup(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusForbidden, w.Body)
+	}
+	if fake.executed("FROM organizations") {
+		t.Error("group read while SCIM is disabled for it")
+	}
+}
+
+func TestSCIMPatchGroupRemoveLastAdmin(t *testing.T) {
+	// A remove without a value targets every member
+	body := `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "remove", "path": "members"}]}`
+
+	db, fake := newFakeDB(t, append([]fakeQuery{
+		{match: "SELECT enabled FROM organization_features", columns: []string{"enabled"}, rows: [][]driver.Value{{true}}},
+		{match: "SELECT owner_id FROM organizations", columns: []string{"owner_id"}, rows: [][]driver.Value{{nil}}},
+		{match: "SELECT user_id FROM user_organization_links", columns: []string{"user_id"}, rows: [][]driver.Value{{testUserID}}},
+		{match: "DELETE FROM user_organization_links", rows: [][]driver.Value{{}}},
+		{match: "INSERT INTO org_audit_log"},
+	}, adminCounts(1, 0)...)...)
+	s := newTestServer(t, db, http.NotFoundHandler())
+
+	r := httptest.NewRequest("PATCH", "/scim/v2/Groups/"+testOrgID, strings.NewReader(body))
+	r = mux.SetURLVars(r, map[string]string{"id": testOrgID})
+	w := httptest.NewRecorder()
+	s.scimPatchGroup(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d (body %s)", w.Code, http.StatusBadRequest, w.Body)
+	}
+	if fake.executed("FROM webhooks") {
+		t.Error("removal of the last admin dispatched")
+	}
+}
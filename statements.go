@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Queries that run on most requests. They are prepared once at startup so
+// Postgres doesn't parse and plan them every time.
+const (
+	userByIDQuery = `
+		SELECT id, email, first_name, last_name, time_zone, ui_mode, can_create_organizations, created_at, updated_at, last_login, last_logout
+		FROM users WHERE id = $1`
+
+	userBlockedQuery = `
+		SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND blocked_at IS NOT NULL)`
+
+	orgByIDQuery = `
+		SELECT id, domain_id, org_id, org_type, name, description, owner_id, data, created_at, updated_at
+		FROM organizations WHERE id = $1 AND deleted_at IS NULL`
+
+	orgMemberCountQuery = `
+		SELECT COUNT(*) FROM user_organization_links uol
+		JOIN organizations o ON o.id = uol.organization_id
+		WHERE uol.user_id = $1 AND uol.organization_id = $2 AND o.deleted_at IS NULL`
+
+	orgPermissionQuery = `
+		SELECT o.owner_id, l.role, r.permissions
+		FROM organizations o
+		LEFT JOIN user_organization_links l ON l.organization_id = o.id AND l.user_id = $1
+		LEFT JOIN org_roles r ON r.org_id = o.id AND r.name = l.role
+		WHERE o.id = $2 AND o.deleted_at IS NULL`
+)
+
+var preparedQueries = []string{
+	userByIDQuery,
+	userBlockedQuery,
+	orgByIDQuery,
+	orgMemberCountQuery,
+	orgPermissionQuery,
+}
+
+// prepareStatements prepares each query, keyed by its text. Queries that
+// fail to prepare are left out and run unprepared instead.
+func prepareStatements(db *sql.DB, queries []string) map[string]*sql.Stmt {
+	stmts := make(map[string]*sql.Stmt, len(queries))
+	for _, query := range queries {
+		stmt, err := db.Prepare(query)
+		if err != nil {
+			logWarning("Failed to prepare statement, it will run unprepared: %v", err)
+			continue
+		}
+		stmts[query] = stmt
+	}
+	logDB("Prepared %d of %d statements", len(stmts), len(queries))
+	return stmts
+}
+
+// queryRow runs query through its prepared statement if there is one
+func (s *Server) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	if stmt, ok := s.stmts[query]; ok {
+		return stmt.QueryRowContext(ctx, args...)
+	}
+	return s.db.QueryRowContext(ctx, query, args...)
+}
+
+// closeStatements releases the prepared statements. Call it before closing
+// the database.
+func (s *Server) closeStatements() {
+	for _, stmt := range s.stmts {
+		if err := stmt.Close(); err != nil {
+			logWarning("Failed to close prepared statement: %v", err)
+		}
+	}
+}
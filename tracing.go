@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until initTracing installs an exporting provider
+var tracer = otel.Tracer("userms")
+
+// initTracing exports spans to OTEL_EXPORTER_OTLP_ENDPOINT over OTLP/HTTP.
+// Tracing stays disabled when no endpoint is configured. The returned
+// function flushes pending spans and should be called on shutdown.
+func initTracing(ctx context.Context, cfg *Config) (func(context.Context) error, error) {
+	if cfg.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	endpoint, err := url.Parse(cfg.OTLPEndpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_ENDPOINT %q", cfg.OTLPEndpoint)
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint.Host)}
+	if endpoint.Path != "" && endpoint.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(endpoint.Path))
+	}
+	if endpoint.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "userms"),
+			attribute.String("service.version", cfg.Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracer = provider.Tracer("userms")
+
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware starts a span per request, continuing the caller's trace
+// if it sent a traceparent header. Like metricsMiddleware, routes are named
+// by their mux template.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		wrapper := &responseWrapper{ResponseWriter: w, statusCode: 200}
+		next.ServeHTTP(wrapper, r.WithContext(ctx))
+
+		span.SetAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.Int("http.status_code", wrapper.statusCode),
+		)
+		if wrapper.statusCode >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(wrapper.statusCode))
+		}
+	})
+}
+
+// startSpan starts a child span of whatever span is in ctx, e.g.
+// startSpan(ctx, "kratos.to_session"). Callers must end it with endSpan.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on the span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingTransport runs each outgoing request to service under a client
+// span named <service>.request and passes the trace context on
+type tracingTransport struct {
+	base    http.RoundTripper
+	service string
+}
+
+func newTracingClient(service string) *http.Client {
+	return &http.Client{Transport: &tracingTransport{base: http.DefaultTransport, service: service}}
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), t.service+".request",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.target", req.URL.Path),
+		),
+	)
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+		}
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+// tracedConnector wraps a database connector so every query and exec runs
+// under a db.query span, whether it is sent directly, prepared or inside a
+// transaction. Statements run without a request context start their own
+// trace.
+type tracedConnector struct {
+	driver.Connector
+}
+
+func (c tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{Conn: conn}, nil
+}
+
+// startDBSpan starts a db.query span for query, named by its first keyword
+// in db.operation
+func startDBSpan(ctx context.Context, query string) (context.Context, trace.Span) {
+	operation := ""
+	if fields := strings.Fields(query); len(fields) > 0 {
+		operation = strings.ToUpper(fields[0])
+	}
+	return startSpan(ctx, "db.query",
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation", operation),
+		attribute.String("db.statement", query),
+	)
+}
+
+// tracedConn passes everything to the wrapped connection. Optional
+// interfaces it lacks are reported with driver.ErrSkip or emulated, as
+// database/sql would.
+type tracedConn struct {
+	driver.Conn
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, span := startDBSpan(ctx, query)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	endSpan(span, err)
+	return rows, err
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, span := startDBSpan(ctx, query)
+	result, err := execer.ExecContext(ctx, query, args)
+	endSpan(span, err)
+	return result, err
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracedStmt{Stmt: stmt, query: query}, nil
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+type tracedStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s *tracedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	ctx, span := startDBSpan(ctx, s.query)
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(namedValues(args))
+	}
+	endSpan(span, err)
+	return rows, err
+}
+
+func (s *tracedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	ctx, span := startDBSpan(ctx, s.query)
+	var result driver.Result
+	var err error
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else {
+		result, err = s.Stmt.Exec(namedValues(args))
+	}
+	endSpan(span, err)
+	return result, err
+}
+
+// namedValues drops the names of positional arguments for drivers that only
+// take plain values
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
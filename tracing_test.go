@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans points tracer at a recorder for the rest of the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := tracer
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() { tracer = previous })
+	return recorder
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) string {
+	for _, attr := range span.Attributes() {
+		if string(attr.Key) == key {
+			return attr.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTracedConnector(t *testing.T) {
+	recorder := recordSpans(t)
+
+	fake := &fakeDB{t: t, queries: []fakeQuery{
+		{match: "SELECT name", columns: []string{"name"}, rows: [][]driver.Value{{"Acme"}}},
+		{match: "UPDATE organizations", rows: [][]driver.Value{{}}},
+	}}
+	db := sql.OpenDB(tracedConnector{fake})
+	defer db.Close()
+
+	ctx, parent := tracer.Start(context.Background(), "request")
+	var name string
+	if err := db.QueryRowContext(ctx, "SELECT name FROM organizations WHERE id = $1", testOrgID).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE organizations SET name = $1", "Acme"); err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := db.PrepareContext(ctx, "SELECT name FROM organizations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stmt.QueryRowContext(ctx).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	stmt.Close()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE organizations SET name = $1", "Acme"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	parent.End()
+
+	var operations []string
+	for _, span := range recorder.Ended() {
+		if span.Name() != "db.query" {
+			continue
+		}
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("db.query span for %q is not a child of the request span", spanAttribute(span, "db.statement"))
+		}
+		operations = append(operations, spanAttribute(span, "db.operation"))
+	}
+	want := []string{"SELECT", "UPDATE", "SELECT", "UPDATE"}
+	if len(operations) != len(want) {
+		t.Fatalf("db.query operations = %v, want %v", operations, want)
+	}
+	for i := range want {
+		if operations[i] != want[i] {
+			t.Errorf("db.query operations = %v, want %v", operations, want)
+			break
+		}
+	}
+}
+
+func TestTracingTransport(t *testing.T) {
+	recorder := recordSpans(t)
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(previous) })
+
+	var traceparent string
+	kratos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer kratos.Close()
+
+	req, _ := http.NewRequest("GET", kratos.URL+"/admin/identities/"+testUserID, nil)
+	resp, err := newTracingClient("kratos").Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "kratos.request" {
+		t.Fatalf("spans = %v, want one kratos.request", spans)
+	}
+	if got := spanAttribute(spans[0], "http.status_code"); got != "404" {
+		t.Errorf("http.status_code = %s, want 404", got)
+	}
+	if traceparent == "" || traceparent[36:52] != spans[0].SpanContext().SpanID().String() {
+		t.Errorf("traceparent = %q, want the span %s propagated", traceparent, spans[0].SpanContext().SpanID())
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// ValidationError describes a single invalid request field
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// Upper bounds on free-text fields, enforced with max=N validate tags
+const (
+	MaxOrgNameLength     = 255
+	MaxDescriptionLength = 2000
+	// RFC 3696 limit: 64 for the local part, @, 255 for the domain
+	MaxEmailLength = 320
+)
+
+// MaxMemberMetadataSize caps a membership's metadata, measured as JSON
+const MaxMemberMetadataSize = 16 * 1024
+
+func validateEmail(email string) error {
+	if email == "" {
+		return &ValidationError{Field: "email", Message: "email is required"}
+	}
+	if len(email) > MaxEmailLength {
+		return &ValidationError{Field: "email", Message: fmt.Sprintf("max length %d exceeded", MaxEmailLength)}
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return &ValidationError{Field: "email", Message: "invalid email address"}
+	}
+	return nil
+}
+
+func validateUUID(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return &ValidationError{Field: "id", Message: "invalid UUID"}
+	}
+	return nil
+}
+
+func validateTimezone(tz string) error {
+	// LoadLocation accepts "" and "Local" which are not IANA names
+	if tz == "" || tz == "Local" {
+		return &ValidationError{Field: "time_zone", Message: "invalid IANA timezone"}
+	}
+	if _, err := time.LoadLocation(tz); err != nil {
+		return &ValidationError{Field: "time_zone", Message: "invalid IANA timezone"}
+	}
+	return nil
+}
+
+func validateURL(u string) error {
+	parsed, err := url.ParseRequestURI(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return &ValidationError{Field: "url", Message: "invalid URL, must be http or https"}
+	}
+	return nil
+}
+
+func validateRole(role string, allowed []string) error {
+	for _, candidate := range allowed {
+		if role == candidate {
+			return nil
+		}
+	}
+	return &ValidationError{
+		Field:   "role",
+		Message: fmt.Sprintf("invalid role, must be one of: %s", strings.Join(allowed, ", ")),
+	}
+}
+
+// validateTag accepts lowercase alphanumeric tags with hyphens, up to 64 chars
+func validateTag(tag string) error {
+	if tag == "" || len(tag) > 64 {
+		return &ValidationError{Field: "tag", Message: "tag must be 1-64 characters"}
+	}
+	for _, c := range tag {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return &ValidationError{Field: "tag", Message: "tag may only contain lowercase letters, digits and hyphens"}
+		}
+	}
+	return nil
+}
+
+// validateRoleName accepts lowercase names made of letters, digits and
+// underscores (e.g. billing_admin) that do not shadow a built-in role
+func validateRoleName(name string) error {
+	if name == "" || len(name) > 50 {
+		return &ValidationError{Field: "name", Message: "role name must be 1-50 characters"}
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return &ValidationError{Field: "name", Message: "role name may only contain lowercase letters, digits and underscores"}
+		}
+	}
+	if validateRole(name, builtinRoles) == nil {
+		return &ValidationError{Field: "name", Message: fmt.Sprintf("%s is a built-in role", name)}
+	}
+	return nil
+}
+
+// validateStruct checks the `validate` tags on the fields of a struct (or
+// pointer to struct). Supported rules: required, omitempty, trim, email,
+// uuid, timezone, url, max=N (characters) and oneof=a b c. Field names are
+// taken from the json tag so errors match the request body the client sent.
+// trim strips surrounding whitespace before the other rules run; it needs a
+// pointer to the struct (or a pointer field) to write the result back.
+func validateStruct(v interface{}) []ValidationError {
+	var errs []ValidationError
+
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return errs
+		}
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return errs
+	}
+
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("validate")
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+
+		fieldVal := val.Field(i)
+		isNil := false
+		if fieldVal.Kind() == reflect.Ptr {
+			isNil = fieldVal.IsNil()
+			if !isNil {
+				fieldVal = fieldVal.Elem()
+			}
+		}
+
+		rules := strings.Split(tag, ",")
+		if !isNil && fieldVal.Kind() == reflect.String && fieldVal.CanSet() {
+			for _, rule := range rules {
+				if rule == "trim" {
+					fieldVal.SetString(strings.TrimSpace(fieldVal.String()))
+				}
+			}
+		}
+		empty := isNil || fieldVal.IsZero()
+
+		for _, rule := range rules {
+			if rule == "required" && empty {
+				errs = append(errs, ValidationError{Field: name, Message: "required"})
+				break
+			}
+		}
+		if empty || fieldVal.Kind() != reflect.String {
+			continue
+		}
+
+		value := fieldVal.String()
+		for _, rule := range rules {
+			var err error
+			switch {
+			case rule == "required" || rule == "omitempty" || rule == "trim":
+				continue
+			case rule == "email":
+				err = validateEmail(value)
+			case rule == "uuid":
+				err = validateUUID(value)
+			case rule == "timezone":
+				err = validateTimezone(value)
+			case rule == "url":
+				err = validateURL(value)
+			case strings.HasPrefix(rule, "max="):
+				limit, convErr := strconv.Atoi(strings.TrimPrefix(rule, "max="))
+				if convErr == nil && utf8.RuneCountInString(value) > limit {
+					err = &ValidationError{Message: fmt.Sprintf("max length %d exceeded", limit)}
+				}
+			case strings.HasPrefix(rule, "oneof="):
+				allowed := strings.Fields(strings.TrimPrefix(rule, "oneof="))
+				if validateRole(value, allowed) != nil {
+					err = &ValidationError{Message: fmt.Sprintf("must be one of: %s", strings.Join(allowed, ", "))}
+				}
+			}
+
+			if ve, ok := err.(*ValidationError); ok {
+				errs = append(errs, ValidationError{Field: name, Message: ve.Message})
+				break
+			}
+		}
+	}
+
+	return errs
+}
+
+// writeValidationErrors responds 400 with every invalid field, e.g.
+// {"code": "VALIDATION_FAILED", "message": "...", "details": {"fields": {"name": "required"}}}
+func writeValidationErrors(w http.ResponseWriter, errs []ValidationError) {
+	fields := make(map[string]string, len(errs))
+	for _, e := range errs {
+		fields[e.Field] = e.Message
+	}
+
+	WriteError(w, http.StatusBadRequest, ErrCodeValidationFailed, "Request validation failed",
+		map[string]interface{}{"fields": fields})
+}
+
+// decodeAndValidate decodes the JSON body into a T and checks its validate
+// tags. On failure the 400 response has already been written and ok is
+// false.
+func decodeAndValidate[T any](w http.ResponseWriter, r *http.Request) (req T, ok bool) {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logWarning("Invalid request body for %s %s: %v", r.Method, r.URL.Path, err)
+		WriteError(w, http.StatusBadRequest, ErrCodeBadRequest, "Invalid request body")
+		return req, false
+	}
+
+	if errs := validateStruct(&req); len(errs) > 0 {
+		logWarning("%s %s failed validation: %v", r.Method, r.URL.Path, errs[0].Error())
+		writeValidationErrors(w, errs)
+		return req, false
+	}
+
+	return req, true
+}
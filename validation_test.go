@@ -0,0 +1,191 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		valid bool
+	}{
+		{"alice@example.com", true},
+		{"alice.smith+tag@sub.example.co.uk", true},
+		{"", false},
+		{"alice", false},
+		{"alice@localhost", false},
+		{"Alice <alice@example.com>", false},
+		{"alice@@example.com", false},
+		{strings.Repeat("a", MaxEmailLength) + "@example.com", false},
+	}
+
+	for _, tt := range tests {
+		err := validateEmail(tt.email)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateEmail(%q) = %v, want valid %v", tt.email, err, tt.valid)
+		}
+		if err != nil {
+			if _, ok := err.(*ValidationError); !ok {
+				t.Errorf("validateEmail(%q) returned %T, want *ValidationError", tt.email, err)
+			}
+		}
+	}
+}
+
+func TestValidateUUID(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"8f14e45f-ceea-467a-9575-09f0f3e3e0f1", true},
+		{"8F14E45F-CEEA-467A-9575-09F0F3E3E0F1", true},
+		{"", false},
+		{"not-a-uuid", false},
+		{"8f14e45f-ceea-467a-9575-09f0f3e3e0f", false},
+	}
+
+	for _, tt := range tests {
+		if err := validateUUID(tt.id); (err == nil) != tt.valid {
+			t.Errorf("validateUUID(%q) = %v, want valid %v", tt.id, err, tt.valid)
+		}
+	}
+}
+
+func TestValidateTimezone(t *testing.T) {
+	tests := []struct {
+		tz    string
+		valid bool
+	}{
+		{"UTC", true},
+		{"Europe/Berlin", true},
+		{"America/New_York", true},
+		{"", false},
+		{"Local", false},
+		{"Mars/Olympus_Mons", false},
+	}
+
+	for _, tt := range tests {
+		if err := validateTimezone(tt.tz); (err == nil) != tt.valid {
+			t.Errorf("validateTimezone(%q) = %v, want valid %v", tt.tz, err, tt.valid)
+		}
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://example.com/hook", true},
+		{"http://example.com:8080", true},
+		{"", false},
+		{"example.com", false},
+		{"ftp://example.com", false},
+		{"https://", false},
+		{"/relative/path", false},
+	}
+
+	for _, tt := range tests {
+		if err := validateURL(tt.url); (err == nil) != tt.valid {
+			t.Errorf("validateURL(%q) = %v, want valid %v", tt.url, err, tt.valid)
+		}
+	}
+}
+
+func TestValidateRole(t *testing.T) {
+	allowed := []string{"admin", "member"}
+	tests := []struct {
+		role  string
+		valid bool
+	}{
+		{"admin", true},
+		{"member", true},
+		{"owner", false},
+		{"", false},
+		{"Admin", false},
+	}
+
+	for _, tt := range tests {
+		err := validateRole(tt.role, allowed)
+		if (err == nil) != tt.valid {
+			t.Errorf("validateRole(%q) = %v, want valid %v", tt.role, err, tt.valid)
+		}
+		if ve, ok := err.(*ValidationError); err != nil && (!ok || ve.Field != "role") {
+			t.Errorf("validateRole(%q) = %#v, want *ValidationError on role", tt.role, err)
+		}
+	}
+}
+
+func TestValidateStruct(t *testing.T) {
+	type request struct {
+		Name     string  `json:"name" validate:"required,trim,max=5"`
+		Email    string  `json:"email" validate:"omitempty,email"`
+		ID       string  `json:"id" validate:"omitempty,uuid"`
+		TimeZone *string `json:"time_zone" validate:"omitempty,timezone"`
+		URL      string  `json:"url" validate:"omitempty,url"`
+		Role     string  `json:"role" validate:"omitempty,oneof=admin member"`
+		Ignored  string  `json:"ignored"`
+	}
+	berlin, mars := "Europe/Berlin", "Mars/Base"
+
+	tests := []struct {
+		name   string
+		req    request
+		fields []string
+	}{
+		{
+			name: "valid",
+			req: request{Name: "acme", Email: "a@example.com", ID: "8f14e45f-ceea-467a-9575-09f0f3e3e0f1",
+				TimeZone: &berlin, URL: "https://example.com", Role: "admin"},
+		},
+		{
+			name:   "missing required",
+			req:    request{},
+			fields: []string{"name"},
+		},
+		{
+			name:   "whitespace only is missing",
+			req:    request{Name: "   "},
+			fields: []string{"name"},
+		},
+		{
+			name:   "too long",
+			req:    request{Name: "abcdef"},
+			fields: []string{"name"},
+		},
+		{
+			name: "every rule failing",
+			req: request{Name: "ok", Email: "nope", ID: "nope", TimeZone: &mars, URL: "nope", Role: "owner",
+				Ignored: "anything"},
+			fields: []string{"email", "id", "time_zone", "url", "role"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateStruct(&tt.req)
+
+			got := make([]string, len(errs))
+			for i, e := range errs {
+				got[i] = e.Field
+			}
+			if strings.Join(got, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("invalid fields = %v, want %v (%v)", got, tt.fields, errs)
+			}
+		})
+	}
+}
+
+func TestValidateStructTrims(t *testing.T) {
+	req := struct {
+		Name string `json:"name" validate:"required,trim"`
+	}{Name: "  acme  "}
+
+	if errs := validateStruct(&req); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if req.Name != "acme" {
+		t.Errorf("Name = %q, want trimmed %q", req.Name, "acme")
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Events organizations can subscribe outbound webhooks to
+const (
+	webhookEventOrgCreated    = "organization.created"
+	webhookEventMemberAdded   = "member.added"
+	webhookEventMemberRemoved = "member.removed"
+	webhookEventRoleChanged   = "member.role_changed"
+	webhookEventTest          = "webhook.test"
+)
+
+var webhookEvents = []string{
+	webhookEventOrgCreated,
+	webhookEventMemberAdded,
+	webhookEventMemberRemoved,
+	webhookEventRoleChanged,
+}
+
+const (
+	webhookWorkers   = 4
+	webhookQueueSize = 256
+	webhookTimeout   = 10 * time.Second
+
+	webhookRetryInterval = 10 * time.Second
+	webhookRetryBatch    = 50
+	// Rows picked up for retry are leased for this long so another
+	// instance does not send them at the same time
+	webhookRetryLease = 5 * time.Minute
+)
+
+// Delay before each retry of a failed delivery. Once these are used up the
+// delivery is marked failed.
+var webhookRetryDelays = []time.Duration{
+	30 * time.Second,
+	2 * time.Minute,
+	10 * time.Minute,
+	time.Hour,
+	4 * time.Hour,
+	24 * time.Hour,
+}
+
+// Carrier-grade NAT space, which some clouds use for their metadata service
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+var errWebhookAddressBlocked = errors.New("webhook URL must not point at a private, loopback or link-local address")
+
+// isBlockedWebhookIP reports whether webhooks must not be sent to ip:
+// loopback, private, link-local (including the 169.254.169.254 metadata
+// address), shared, unspecified and multicast addresses
+func isBlockedWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+}
+
+// checkWebhookURL resolves the URL's host and rejects it if any of its
+// addresses is blocked. The webhook client checks again when dialing, since
+// DNS may answer differently by then.
+func checkWebhookURL(ctx context.Context, rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, parsed.Hostname())
+	if err != nil {
+		return fmt.Errorf("cannot resolve webhook host %s: %w", parsed.Hostname(), err)
+	}
+	for _, addr := range addrs {
+		if isBlockedWebhookIP(addr.IP) {
+			return errWebhookAddressBlocked
+		}
+	}
+	return nil
+}
+
+// newWebhookClient returns the client webhooks are sent with. It refuses to
+// connect to blocked addresses, whatever the hostname resolved to, and
+// does not follow redirects, so an endpoint can't bounce deliveries to an
+// internal service.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isBlockedWebhookIP(ip) {
+				return errWebhookAddressBlocked
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		// No proxy: the dial check must see the endpoint's own address
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+type webhookJob struct {
+	webhook Webhook
+	event   string
+	payload []byte
+	// retry schedules failed deliveries for another attempt. Test events
+	// are reported to the caller instead.
+	retry bool
+}
+
+// startWebhookWorkers launches the pool that delivers queued webhook events
+// until ctx is cancelled
+func (s *Server) startWebhookWorkers(ctx context.Context, n int) {
+	for i := 0; i < n; i++ {
+		s.goBackground(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-s.webhookQueue:
+					s.deliverWebhook(job)
+				}
+			}
+		})
+	}
+}
+
+// dispatchWebhookEvent queues event for every active webhook of orgID that
+// subscribes to it. Delivery happens in the background; call it only after
+// the change has been committed.
+func (s *Server) dispatchWebhookEvent(orgID, event string, data map[string]interface{}) {
+	rows, err := s.db.Query(`
+		SELECT id, org_id, url, secret, events, is_active, created_at
+		FROM webhooks
+		WHERE org_id = $1 AND is_active AND $2 = ANY(events)`,
+		orgID, event,
+	)
+	if err != nil {
+		logError("Failed to look up webhooks for organization %s: %v", orgID, err)
+		return
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		var hook Webhook
+		err := rows.Scan(&hook.ID, &hook.OrgID, &hook.URL, &hook.Secret, pq.Array(&hook.Events), &hook.IsActive, &hook.CreatedAt)
+		if err != nil {
+			logWarning("Error scanning webhook row: %v", err)
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	payload, err := buildWebhookPayload(orgID, event, data)
+	if err != nil {
+		logError("Failed to encode %s webhook payload: %v", event, err)
+		return
+	}
+
+	for _, hook := range hooks {
+		select {
+		case s.webhookQueue <- webhookJob{webhook: hook, event: event, payload: payload, retry: true}:
+		default:
+			logWarning("Webhook queue full, dropping %s event for webhook %s", event, hook.ID)
+		}
+	}
+}
+
+func buildWebhookPayload(orgID, event string, data map[string]interface{}) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"id":         uuid.New().String(),
+		"event":      event,
+		"org_id":     orgID,
+		"created_at": time.Now().UTC(),
+		"data":       data,
+	})
+}
+
+// deliverWebhook POSTs the payload signed with the webhook's secret and
+// records the outcome in webhook_deliveries. Failed deliveries of retryable
+// jobs are left pending for retryWebhookDeliveries.
+func (s *Server) deliverWebhook(job webhookJob) (int, error) {
+	statusCode, err := s.sendWebhook(job.webhook, job.event, job.payload)
+	if err != nil {
+		logWarning("Webhook %s delivery of %s failed: %v", job.webhook.ID, job.event, err)
+	} else {
+		logInfo("Webhook %s delivered %s (%d)", job.webhook.ID, job.event, statusCode)
+	}
+
+	status, nextRetryAt := deliveryOutcome(err, 1, job.retry)
+
+	_, dbErr := s.db.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event_type, payload, status, attempts, next_retry_at, response_code, last_error)
+		VALUES ($1, $2, $3, $4, 1, $5, $6, $7)`,
+		job.webhook.ID, job.event, string(job.payload), status, nextRetryAt,
+		nullableStatusCode(statusCode), nullableError(err),
+	)
+	if dbErr != nil {
+		logError("Failed to record delivery for webhook %s: %v", job.webhook.ID, dbErr)
+	}
+
+	return statusCode, err
+}
+
+// retryWebhookDeliveries polls for pending deliveries whose retry time has
+// come and sends them again, until ctx is cancelled.
+func (s *Server) retryWebhookDeliveries(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		rows, err := s.db.Query(`
+			UPDATE webhook_deliveries d
+			SET next_retry_at = NOW() + $1 * INTERVAL '1 second'
+			FROM webhooks w
+			WHERE d.webhook_id = w.id AND d.id IN (
+				SELECT id FROM webhook_deliveries
+				WHERE status = 'pending' AND next_retry_at <= NOW()
+				ORDER BY next_retry_at
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING d.id, d.event_type, d.payload, d.attempts, w.id, w.url, w.secret, w.is_active`,
+			int(webhookRetryLease.Seconds()), webhookRetryBatch,
+		)
+		if err != nil {
+			logError("Failed to fetch webhook deliveries to retry: %v", err)
+			continue
+		}
+
+		type pendingDelivery struct {
+			id       string
+			attempts int
+			job      webhookJob
+		}
+		var pending []pendingDelivery
+		for rows.Next() {
+			var d pendingDelivery
+			var payload string
+			err := rows.Scan(&d.id, &d.job.event, &payload, &d.attempts,
+				&d.job.webhook.ID, &d.job.webhook.URL, &d.job.webhook.Secret, &d.job.webhook.IsActive)
+			if err != nil {
+				logWarning("Error scanning webhook delivery row: %v", err)
+				continue
+			}
+			d.job.payload = []byte(payload)
+			pending = append(pending, d)
+		}
+		rows.Close()
+
+		for _, d := range pending {
+			var statusCode int
+			var err error
+			if d.job.webhook.IsActive {
+				statusCode, err = s.sendWebhook(d.job.webhook, d.job.event, d.job.payload)
+			} else {
+				err = fmt.Errorf("webhook disabled")
+			}
+
+			attempts := d.attempts + 1
+			status, nextRetryAt := deliveryOutcome(err, attempts, d.job.webhook.IsActive)
+			if err != nil {
+				logWarning("Webhook %s attempt %d of %s failed: %v", d.job.webhook.ID, attempts, d.job.event, err)
+			} else {
+				logInfo("Webhook %s delivered %s on attempt %d", d.job.webhook.ID, d.job.event, attempts)
+			}
+
+			_, dbErr := s.db.Exec(`
+				UPDATE webhook_deliveries
+				SET status = $1, attempts = $2, next_retry_at = $3, response_code = $4, last_error = $5
+				WHERE id = $6`,
+				status, attempts, nextRetryAt, nullableStatusCode(statusCode), nullableError(err), d.id,
+			)
+			if dbErr != nil {
+				logError("Failed to update webhook delivery %s: %v", d.id, dbErr)
+			}
+		}
+	}
+}
+
+// deliveryOutcome returns the status to store after the given attempt and,
+// for pending deliveries, when to try again
+func deliveryOutcome(err error, attempts int, retry bool) (string, *time.Time) {
+	if err == nil {
+		return "delivered", nil
+	}
+	if !retry || attempts > len(webhookRetryDelays) {
+		return "failed", nil
+	}
+	next := time.Now().Add(webhookRetryDelays[attempts-1])
+	return "pending", &next
+}
+
+func nullableStatusCode(code int) *int {
+	if code == 0 {
+		return nil
+	}
+	return &code
+}
+
+func nullableError(err error) *string {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	return &msg
+}
+
+func (s *Server) sendWebhook(hook Webhook, event string, payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write(payload)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsBlockedWebhookIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"93.184.216.34", false},
+		{"2606:2800:220:1:248:1893:25c8:1946", false},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.100.100.200", true},
+		{"fd00:ec2::254", true},
+		{"fe80::1", true},
+		{"0.0.0.0", true},
+		{"224.0.0.1", true},
+	}
+
+	for _, tt := range tests {
+		if got := isBlockedWebhookIP(net.ParseIP(tt.ip)); got != tt.blocked {
+			t.Errorf("isBlockedWebhookIP(%s) = %v, want %v", tt.ip, got, tt.blocked)
+		}
+	}
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://93.184.216.34/hook", true},
+		{"http://127.0.0.1:8080/hook", false},
+		{"http://localhost/hook", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://[::1]/hook", false},
+	}
+
+	for _, tt := range tests {
+		if err := checkWebhookURL(context.Background(), tt.url); (err == nil) != tt.allowed {
+			t.Errorf("checkWebhookURL(%s) = %v, want allowed %v", tt.url, err, tt.allowed)
+		}
+	}
+}
+
+func TestWebhookClientRefusesBlockedAddresses(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("webhook reached a loopback server")
+	}))
+	defer internal.Close()
+
+	_, err := newWebhookClient().Post(internal.URL, "application/json", strings.NewReader("{}"))
+	if !errors.Is(err, errWebhookAddressBlocked) {
+		t.Errorf("err = %v, want %v", err, errWebhookAddressBlocked)
+	}
+}
+
+func TestWebhookClientDoesNotFollowRedirects(t *testing.T) {
+	req := httptest.NewRequest("POST", "http://93.184.216.34/redirected", nil)
+	via := []*http.Request{httptest.NewRequest("POST", "http://93.184.216.34/hook", nil)}
+	if err := newWebhookClient().CheckRedirect(req, via); err != http.ErrUseLastResponse {
+		t.Errorf("CheckRedirect = %v, want http.ErrUseLastResponse", err)
+	}
+}
+
+func TestCreateWebhookRejectsInternalURL(t *testing.T) {
+	db, fake := newFakeDB(t, membershipQueries(testOwnerID, "admin", nil)...)
+	s := newTestServer(t, db, http.NotFoundHandler())
+
+	body := `{"org_id": "` + testOrgID + `", "url": "http://169.254.169.254/latest/meta-data/"}`
+	r := withSession(httptest.NewRequest("POST", "/webhooks", strings.NewReader(body)), testOwnerID, nil)
+	w := httptest.NewRecorder()
+	s.createWebhook(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400 (body %s)", w.Code, w.Body)
+	}
+	if fake.executed("INSERT INTO webhooks") {
+		t.Error("webhook to the metadata address was stored")
+	}
+}
+
+func TestValidateWebhookSignature(t *testing.T) {
+	const secret = "hook-secret"
+	sign := func(body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	oversized := `{"padding": "` + strings.Repeat("a", maxWebhookBodyBytes) + `"}`
+
+	tests := []struct {
+		name      string
+		body      string
+		signature string
+		status    int
+	}{
+		{"valid", `{"identity": {}}`, sign(`{"identity": {}}`), http.StatusOK},
+		{"missing signature", `{"identity": {}}`, "", http.StatusUnauthorized},
+		{"wrong signature", `{"identity": {}}`, sign(`{"identity": null}`), http.StatusUnauthorized},
+		{"too large", oversized, sign(oversized), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{cfg: &Config{WebhookSecret: secret}}
+			handler := s.validateWebhookSignature(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != tt.body {
+					t.Errorf("handler got body %q, want %q", body, tt.body)
+				}
+			}))
+
+			r := httptest.NewRequest("POST", "/hooks/after-login", strings.NewReader(tt.body))
+			r.Header.Set("X-Kratos-Hook-HMAC-SHA256", tt.signature)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}